@@ -3,11 +3,14 @@
 BINARY_FILE=./mal-go
 TESTS_FOLDER=./tests
 TEST_RUNNER=./runtest.py
+# the libs required by the tests
+export MALPATH=$TESTS_FOLDER/lib
 
 # echo
 echo "BINARY_FILE   $BINARY_FILE"
 echo "TESTS_FOLDER  $TESTS_FOLDER"
 echo "TEST_RUNNER   $TEST_RUNNER"
+echo "MALPATH       $MALPATH"
 
 # make sure the  binary file has been correctly generated
 if [[ ! -f $BINARY_FILE ]]; then
@@ -25,6 +28,16 @@ do
         if [[ ! 0 -eq $? ]]; then
             let FAIL=1
         fi
+        echo "Run test cases in $file on the bytecode VM"
+        python $TEST_RUNNER $file -- $BINARY_FILE -vm
+        if [[ ! 0 -eq $? ]]; then
+            let FAIL=1
+        fi
+        echo "Run test cases in $file with the optimizer"
+        python $TEST_RUNNER $file -- $BINARY_FILE -optimize
+        if [[ ! 0 -eq $? ]]; then
+            let FAIL=1
+        fi
     fi
 done
 exit $FAIL
\ No newline at end of file
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/core"
+	"github.com/jiayouxujin/mal-go/mal"
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+	"sort"
+	"strings"
+	"time"
+)
+
+// session is the state of an interactive REPL
+type session struct {
+	in *mal.Interp
+	// ctx is canceled when the running command is interrupted
+	ctx  context.Context
+	quit bool
+}
+
+// historySymbols hold the last three results and the last error in the REPL
+var historySymbols = []string{"*1", "*2", "*3", "*e"}
+
+// record binds v to *1 shifting the previous results to *2 and *3, or err to *e
+func (s *session) record(v MalType, err error) {
+	if err != nil {
+		_ = s.in.Env().Set(MalSymbol{Value: "*e"}, MalString{Value: err.Error()})
+		return
+	}
+	for i := 2; i > 0; i-- {
+		prev, _ := s.in.Env().Get(MalSymbol{Value: historySymbols[i-1]})
+		_ = s.in.Env().Set(MalSymbol{Value: historySymbols[i]}, prev)
+	}
+	_ = s.in.Env().Set(MalSymbol{Value: "*1"}, v)
+}
+
+// metaCommand is a REPL command starting with ':' which is handled before `rep`
+type metaCommand struct {
+	usage string
+	help  string
+	run   func(s *session, arg string) error
+}
+
+var metaCommands map[string]metaCommand
+
+func init() {
+	// initialized here since `:help` refers to metaCommands itself
+	metaCommands = map[string]metaCommand{
+		":env":   {":env", "list the bindings in the REPL environment", envCommand},
+		":doc":   {":doc sym", "show the documentation of a symbol", docCommand},
+		":time":  {":time expr", "evaluate expr and report the elapsed time", timeCommand},
+		":load":  {":load file", "evaluate all forms in a file", loadCommand},
+		":reset": {":reset", "start over with a fresh environment", resetCommand},
+		":quit":  {":quit", "exit the REPL", quitCommand},
+		":help":  {":help", "list the REPL commands", helpCommand},
+	}
+}
+
+// parseCommand returns the meta command in input if there is one
+// it's important to only match known commands since keywords also start with ':'
+func parseCommand(input string) (metaCommand, string, bool) {
+	input = strings.TrimSpace(input)
+	name, arg := input, ""
+	if i := strings.IndexAny(input, " \t"); i >= 0 {
+		name, arg = input[:i], strings.TrimSpace(input[i:])
+	}
+	cmd, ok := metaCommands[name]
+	return cmd, arg, ok
+}
+
+func envCommand(s *session, _ string) error {
+	names := s.in.Env().Symbols()
+	sort.Strings(names)
+	opts := printer.OptionsFromEnv(s.in.Env(), true)
+	for _, name := range names {
+		v, err := s.in.Env().Get(MalSymbol{Value: name})
+		if err != nil {
+			return err
+		}
+		var sb strings.Builder
+		if err := printer.Fprint(&sb, v, opts); err != nil {
+			return err
+		}
+		fmt.Printf("%s = %s\n", name, sb.String())
+	}
+	return nil
+}
+
+func docCommand(s *session, arg string) error {
+	if arg == "" {
+		return fmt.Errorf("usage: :doc sym")
+	}
+	if doc, ok := mal.SpecialForms[arg]; ok {
+		fmt.Printf("%s\n  Special form\n", doc)
+		return nil
+	}
+	v, err := s.in.Env().Get(MalSymbol{Value: arg})
+	if err != nil {
+		return fmt.Errorf("failed to look up '%s' in environments", arg)
+	}
+	if doc, ok := core.Docs[arg]; ok {
+		if b, ok := v.(MalBuiltin); ok && b.Name == arg {
+			fmt.Println(doc)
+			return nil
+		}
+	}
+	fmt.Println(printer.PrStr(v, true))
+	return nil
+}
+
+func timeCommand(s *session, arg string) error {
+	start := time.Now()
+	v, res, err := rep(s.ctx, arg, s.in)
+	elapsed := time.Since(start)
+	s.record(v, err)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v\nElapsed time: %v\n", res, elapsed)
+	return nil
+}
+
+func loadCommand(s *session, arg string) error {
+	if arg == "" {
+		return fmt.Errorf("usage: :load file")
+	}
+	return loadFile(s.ctx, arg, s.in)
+}
+
+func resetCommand(s *session, _ string) error {
+	s.in = newInterp()
+	return nil
+}
+
+func quitCommand(s *session, _ string) error {
+	s.quit = true
+	return nil
+}
+
+func helpCommand(_ *session, _ string) error {
+	names := make([]string, 0, len(metaCommands))
+	for name := range metaCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%-12s %s\n", metaCommands[name].usage, metaCommands[name].help)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+)
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	_ = w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestTimeCommand(t *testing.T) {
+	s := &session{in: newInterp(), ctx: context.Background()}
+	cmd, arg, ok := parseCommand(":time (+ 1 2)")
+	if !ok {
+		t.Fatal(":time isn't parsed as a command")
+	}
+	out := captureStdout(t, func() {
+		if err := cmd.run(s, arg); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !regexp.MustCompile(`^3\nElapsed time: \S+\n$`).MatchString(out) {
+		t.Errorf(":time (+ 1 2) prints %q", out)
+	}
+	if err := cmd.run(s, "(nope)"); err == nil {
+		t.Error(":time (nope) succeeds, want an error")
+	}
+}
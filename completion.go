@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/jiayouxujin/mal-go/env"
+	"github.com/jiayouxujin/mal-go/mal"
+	. "github.com/jiayouxujin/mal-go/types"
+	"sort"
+	"strings"
+)
+
+// seenKeywords records the keywords read in this session for completion
+var seenKeywords = make(map[string]bool)
+
+// collectKeywords adds all keywords in ast to seenKeywords
+func collectKeywords(ast MalType) {
+	switch t := ast.(type) {
+	case MalKeyword:
+		seenKeywords[":"+t.Value] = true
+	case MalList:
+		for _, item := range t {
+			collectKeywords(item)
+		}
+	case MalVector:
+		for _, item := range t {
+			collectKeywords(item)
+		}
+	case MalHashmap:
+		for k, v := range t {
+			collectKeywords(k)
+			collectKeywords(v)
+		}
+	}
+}
+
+// completeSymbol returns the sorted symbols bound in replEnv, special forms and seen keywords
+// starting with prefix
+func completeSymbol(replEnv *env.Env, prefix string) []string {
+	var candidates []string
+	if strings.HasPrefix(prefix, ":") {
+		for k := range seenKeywords {
+			candidates = append(candidates, k)
+		}
+	} else {
+		candidates = replEnv.Symbols()
+		for name := range mal.SpecialForms {
+			candidates = append(candidates, name)
+		}
+	}
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) && !seen[c] {
+			seen[c] = true
+			result = append(result, c)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jiayouxujin/mal-go/mal"
+)
+
+func TestCompleteSymbol(t *testing.T) {
+	in := mal.New()
+	for _, src := range []string{`(def! string-length (fn* (s) (count s)))`, `{:timeout 1 :tag "x"}`} {
+		if _, _, err := rep(context.Background(), src, in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"str", []string{"str", "string-length"}},
+		{"def", []string{"def!"}},
+		{"le", []string{"let*"}},
+		{":t", []string{":tag", ":timeout"}},
+		{"nope", []string{}},
+	}
+	for _, test := range tests {
+		if got := completeSymbol(in.Env(), test.prefix); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("completeSymbol(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
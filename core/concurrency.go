@@ -0,0 +1,259 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/types"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// assertChannel asserts that `arg` is a channel
+func assertChannel(arg types.MalType) (*types.MalChannel, error) {
+	ch, ok := arg.(*types.MalChannel)
+	if !ok {
+		return nil, fmt.Errorf("incorrect arguments type: channel is expected")
+	}
+	return ch, nil
+}
+
+// createChannel creates an unbuffered channel or a buffered one when the size is given
+func createChannel(args ...types.MalType) (types.MalType, error) {
+	if len(args) == 0 {
+		return types.NewChannel(0), nil
+	}
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	size, ok := args[0].(types.MalNumber)
+	if !ok || size.Value < 0 {
+		return nil, fmt.Errorf("the buffer size is expected to be a non-negative number")
+	}
+	return types.NewChannel(size.Value), nil
+}
+
+func isChannel(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	_, ok := args[0].(*types.MalChannel)
+	return types.ToMalBool(ok), nil
+}
+
+// putChannel blocks until the value is sent, it returns false if the channel is closed
+func putChannel(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 2); err != nil {
+		return nil, err
+	}
+	ch, err := assertChannel(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if args[1] == types.MalNil {
+		return nil, fmt.Errorf("can't put nil on a channel")
+	}
+	ok, err := ch.Put(ctx, args[1])
+	if err != nil {
+		return nil, err
+	}
+	return types.ToMalBool(ok), nil
+}
+
+// takeChannel blocks until a value is received, it returns nil if the channel is closed
+func takeChannel(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	ch, err := assertChannel(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return ch.Take(ctx)
+}
+
+func closeChannel(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	ch, err := assertChannel(args[0])
+	if err != nil {
+		return nil, err
+	}
+	ch.Close()
+	return types.MalNil, nil
+}
+
+// alts completes at most one of the operations in `ports`, which are either channels to take
+// from or [channel value] vectors to put on, and returns [value port]
+// with `:timeout ms` it returns [nil :timeout] if nothing is ready in time
+func alts(ctx context.Context, args ...types.MalType) (result types.MalType, err error) {
+	if len(args) != 1 && len(args) != 3 {
+		return nil, fmt.Errorf("incorrect number of arguments: expect 1 or 3 but get %d", len(args))
+	}
+	var ports []types.MalType
+	switch t := args[0].(type) {
+	case types.MalList:
+		ports = t
+	case types.MalVector:
+		ports = t
+	default:
+		return nil, fmt.Errorf("the ports are expected to be a vector")
+	}
+	cases := make([]reflect.SelectCase, 0, len(ports)+2)
+	for _, port := range ports {
+		switch t := port.(type) {
+		case *types.MalChannel:
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.Ch)})
+		case types.MalVector:
+			if len(t) != 2 {
+				return nil, fmt.Errorf("a put is expected to be [channel value]")
+			}
+			ch, err := assertChannel(t[0])
+			if err != nil {
+				return nil, err
+			}
+			if t[1] == types.MalNil {
+				return nil, fmt.Errorf("can't put nil on a channel")
+			}
+			if ch.Closed() {
+				return types.MalVector{types.MalFalse, port}, nil
+			}
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(ch.Ch),
+				Send: reflect.ValueOf(&t[1]).Elem(),
+			})
+		default:
+			return nil, fmt.Errorf("a port is expected to be a channel or [channel value]")
+		}
+	}
+	timeoutKeyword := types.MalKeyword{Value: "timeout"}
+	if len(args) == 3 {
+		ms, ok := args[2].(types.MalNumber)
+		if args[1] != timeoutKeyword || !ok {
+			return nil, fmt.Errorf("the options are expected to be :timeout ms")
+		}
+		timer := time.NewTimer(time.Duration(ms.Value) * time.Millisecond)
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	defer func() {
+		// a channel may be closed while blocking on sending
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("put on a closed channel")
+		}
+	}()
+	chosen, recv, ok := reflect.Select(cases)
+	switch {
+	case chosen == len(cases)-1:
+		return nil, ctx.Err()
+	case chosen == len(ports):
+		return types.MalVector{types.MalNil, timeoutKeyword}, nil
+	case cases[chosen].Dir == reflect.SelectSend:
+		return types.MalVector{types.MalTrue, ports[chosen]}, nil
+	case !ok:
+		return types.MalVector{types.MalNil, ports[chosen]}, nil
+	default:
+		return types.MalVector{recv.Interface(), ports[chosen]}, nil
+	}
+}
+
+/* Futures and promises */
+
+func createPromise(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 0); err != nil {
+		return nil, err
+	}
+	return types.NewPromise(), nil
+}
+
+// deliver sets the value of a promise, it returns nil if the promise is already delivered
+func deliver(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 2); err != nil {
+		return nil, err
+	}
+	p, ok := args[0].(*types.MalPromise)
+	if !ok {
+		return nil, fmt.Errorf("incorrect arguments type: promise is expected")
+	}
+	if !p.Deliver(args[1], nil) {
+		return types.MalNil, nil
+	}
+	return p, nil
+}
+
+func isRealized(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	switch t := args[0].(type) {
+	case *types.MalFuture:
+		return types.ToMalBool(t.Realized()), nil
+	case *types.MalPromise:
+		return types.ToMalBool(t.Realized()), nil
+	default:
+		return nil, fmt.Errorf("can't check whether %s is realized", types.TypeName(args[0]))
+	}
+}
+
+// pmap is like map but applies f to the elements on GOMAXPROCS goroutines, preserving the order
+func pmap(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 2); err != nil {
+		return nil, err
+	}
+	var items []types.MalType
+	switch t := args[1].(type) {
+	case types.MalList:
+		items = t
+	case types.MalVector:
+		items = t
+	default:
+		if args[1] != types.MalNil {
+			return nil, fmt.Errorf("the collection is expected to be a list or vector")
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(types.MalList, len(items))
+	indexes := make(chan int)
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				v, err := types.CallContext(ctx, args[0], items[i])
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				result[i] = v
+			}
+		}()
+	}
+feed:
+	for i := range items {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -1,12 +1,15 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"github.com/jiayouxujin/mal-go/printer"
 	"github.com/jiayouxujin/mal-go/reader"
 	"github.com/jiayouxujin/mal-go/types"
 	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 )
 
 // AssertLength asserts the length of a list
@@ -96,14 +99,23 @@ func strUnreadable(args ...types.MalType) (types.MalType, error) {
 	return types.MalString{Value: toJoinedString(args, "", false)}, nil
 }
 
-func printReadable(args ...types.MalType) (types.MalType, error) {
-	fmt.Println(toJoinedString(args, " ", true))
-	return types.MalNil, nil
+// printTo returns a function printing its arguments to stdout, limited by `*print-length*`
+// and `*print-level*` in env
+func printTo(env types.MalEnv, readable bool) types.MalFunction {
+	return func(args ...types.MalType) (types.MalType, error) {
+		if err := printer.Fprintln(os.Stdout, printer.OptionsFromEnv(env, readable), args...); err != nil {
+			return nil, err
+		}
+		return types.MalNil, nil
+	}
 }
 
-func printUnreadable(args ...types.MalType) (types.MalType, error) {
-	fmt.Println(toJoinedString(args, " ", false))
-	return types.MalNil, nil
+func printReadable(env types.MalEnv) types.MalFunction {
+	return printTo(env, true)
+}
+
+func printUnreadable(env types.MalEnv) types.MalFunction {
+	return printTo(env, false)
 }
 
 /* List related functions */
@@ -247,3 +259,81 @@ func slurp(args ...types.MalType) (types.MalType, error) {
 	}
 	return types.MalString{Value: string(content)}, nil
 }
+
+/* Atom related functions */
+
+func createAtom(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	return &types.MalAtom{Value: args[0]}, nil
+}
+
+func isAtom(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	_, ok := args[0].(*types.MalAtom)
+	return types.ToMalBool(ok), nil
+}
+
+// deref returns the value of an atom, or waits for a future or promise to be delivered
+// (deref x timeout-ms timeout-val) returns timeout-val if x isn't delivered in time
+func deref(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if len(args) != 1 && len(args) != 3 {
+		return nil, fmt.Errorf("incorrect number of arguments: expect 1 or 3 but get %d", len(args))
+	}
+	timeout := time.Duration(-1)
+	if len(args) == 3 {
+		ms, ok := args[1].(types.MalNumber)
+		if !ok {
+			return nil, fmt.Errorf("the timeout is expected to be a number of milliseconds")
+		}
+		timeout = time.Duration(ms.Value) * time.Millisecond
+	}
+	var v types.MalType
+	var err error
+	switch t := args[0].(type) {
+	case *types.MalAtom:
+		return t.Deref(), nil
+	case *types.MalRef:
+		return derefRef(ctx, t)
+	case *types.MalAgent:
+		return t.Deref(), nil
+	case *types.MalFuture:
+		v, err = t.Wait(ctx, timeout)
+	case *types.MalPromise:
+		v, err = t.Wait(ctx, timeout)
+	default:
+		return nil, fmt.Errorf("can't deref %s", types.TypeName(args[0]))
+	}
+	if err == types.ErrDerefTimeout {
+		return args[2], nil
+	}
+	return v, err
+}
+
+func resetAtom(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 2); err != nil {
+		return nil, err
+	}
+	atom, ok := args[0].(*types.MalAtom)
+	if !ok {
+		return nil, fmt.Errorf("can't reset a non-atom")
+	}
+	return atom.Reset(args[1]), nil
+}
+
+// swapAtom sets the atom to (f old-value args...)
+func swapAtom(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("incorrect number of arguments: expect at least 2 but get %d", len(args))
+	}
+	atom, ok := args[0].(*types.MalAtom)
+	if !ok {
+		return nil, fmt.Errorf("can't swap a non-atom")
+	}
+	return atom.Swap(func(old types.MalType) (types.MalType, error) {
+		return types.CallContext(ctx, args[1], append(types.MalList{old}, args[2:]...)...)
+	})
+}
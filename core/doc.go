@@ -0,0 +1,58 @@
+package core
+
+// Docs contains the usage and description of builtins, shown by `:doc` in the REPL
+var Docs = map[string]string{
+	"+": "(+ a b)\n  Returns the sum of numbers a and b",
+	"-": "(- a b)\n  Returns a minus b",
+	"*": "(* a b)\n  Returns the product of numbers a and b",
+	"/": "(/ a b)\n  Returns the integer quotient of a divided by b",
+
+	"eval":     "(eval form)\n  Evaluates form in the global environment",
+	"optimize": "(optimize form)\n  Returns form with pure calls on literals folded, dead branches dropped and small functions inlined",
+
+	"pr-str":      "(pr-str & xs)\n  Returns the readable representations of xs joined by spaces",
+	"str":         "(str & xs)\n  Returns the representations of xs concatenated",
+	"prn":         "(prn & xs)\n  Prints the readable representations of xs and a newline",
+	"println":     "(println & xs)\n  Prints the representations of xs and a newline",
+	"read-string": "(read-string s)\n  Reads a mal form from string s",
+	"slurp":       "(slurp filename)\n  Returns the content of a file as a string",
+
+	"list":   "(list & xs)\n  Returns a list containing xs",
+	"list?":  "(list? x)\n  Returns true if x is a list",
+	"empty?": "(empty? lst)\n  Returns true if lst has no elements",
+	"count":  "(count lst)\n  Returns the number of elements in lst",
+
+	"=":  "(= a b)\n  Returns true if a and b are equal",
+	"<":  "(< a b)\n  Returns true if a is less than b",
+	"<=": "(<= a b)\n  Returns true if a is less than or equal to b",
+	">":  "(> a b)\n  Returns true if a is greater than b",
+	">=": "(>= a b)\n  Returns true if a is greater than or equal to b",
+
+	"atom":   "(atom x)\n  Returns an atom holding x",
+	"atom?":  "(atom? x)\n  Returns true if x is an atom",
+	"deref":  "(deref x timeout-ms? timeout-val?)\n  Returns the value of an atom, ref or agent, or waits for a future or promise to be delivered",
+	"reset!": "(reset! a x)\n  Sets the value of atom a to x and returns x",
+	"swap!":  "(swap! a f & args)\n  Sets the value of atom a to (f old-value args...) and returns it",
+
+	"chan":   "(chan size?)\n  Returns a channel, buffered if size is given",
+	"chan?":  "(chan? x)\n  Returns true if x is a channel",
+	">!":     "(>! ch x)\n  Puts x on channel ch, returns false if ch is closed",
+	"<!":     "(<! ch)\n  Takes a value from channel ch, returns nil if ch is closed",
+	"close!": "(close! ch)\n  Closes channel ch",
+	"alts!":  "(alts! [ch-or-[ch x] ...] :timeout ms?)\n  Takes from or puts on the first ready channel, returns [value channel]",
+
+	"promise":   "(promise)\n  Returns a promise to be delivered once",
+	"deliver":   "(deliver p x)\n  Delivers x to promise p, returns nil if p is already delivered",
+	"realized?": "(realized? x)\n  Returns true if future or promise x is delivered",
+	"pmap":      "(pmap f coll)\n  Like map, but applies f to the elements of coll in parallel",
+
+	"ref":         "(ref x)\n  Returns a ref holding x, changed only in transactions",
+	"alter":       "(alter r f & args)\n  Sets ref r to (f value args...) in the transaction and returns it",
+	"commute":     "(commute r f & args)\n  Like alter, but f is applied again to the latest value on commit so it never conflicts",
+	"ref-set":     "(ref-set r x)\n  Sets ref r to x in the transaction and returns x",
+	"ensure":      "(ensure r)\n  Returns the value of ref r and keeps other transactions from changing it until commit",
+	"agent":       "(agent x)\n  Returns an agent holding x",
+	"send":        "(send a f & args)\n  Sets agent a to (f state args...) asynchronously, held until commit in a transaction",
+	"await":       "(await & agents)\n  Waits for the actions sent to the agents so far to be done",
+	"agent-error": "(agent-error a)\n  Returns the error which failed agent a, or nil",
+}
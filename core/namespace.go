@@ -12,8 +12,6 @@ var NameSpace = map[string]types.MalFunction{
 	// string functions
 	"pr-str":      strReadable,
 	"str":         strUnreadable,
-	"prn":         printReadable,
-	"println":     printUnreadable,
 	"read-string": readString,
 	"slurp":       slurp,
 	// list related operations
@@ -27,10 +25,52 @@ var NameSpace = map[string]types.MalFunction{
 	"<=": isLessEqual,
 	">":  isGreater,
 	">=": isGreaterEqual,
+	// atoms
+	"atom":   createAtom,
+	"atom?":  isAtom,
+	"reset!": resetAtom,
+	// channels
+	"chan":   createChannel,
+	"chan?":  isChannel,
+	"close!": closeChannel,
+	// futures and promises
+	"promise":   createPromise,
+	"deliver":   deliver,
+	"realized?": isRealized,
+	// refs and agents
+	"ref":         createRef,
+	"agent":       createAgent,
+	"agent-error": agentError,
+}
+
+// CtxNameSpace contains functions which may block until the evaluation is canceled, or which call
+// mal functions that have to run in the evaluation calling them
+var CtxNameSpace = map[string]types.MalContextFunction{
+	">!":    putChannel,
+	"<!":    takeChannel,
+	"alts!": alts,
+	"deref": deref,
+	"swap!": swapAtom,
+	"pmap":  pmap,
+	// refs and agents
+	"alter":   alter,
+	"commute": commute,
+	"ref-set": refSet,
+	"ensure":  ensure,
+	"send":    send,
+	"await":   await,
+}
+
+// EnvNameSpace contains functions which need the environment they are installed in
+var EnvNameSpace = map[string]func(env types.MalEnv) types.MalFunction{
+	"prn":     printReadable,
+	"println": printUnreadable,
 }
 
 // InitCommands contain mal commands to be executed in sequence during initialization
 var InitCommands = []string{
+	`(def! *print-length* nil)`,
+	`(def! *print-level* nil)`,
 	`(def! not (fn* (a) (if a false true)))`,
 	`(def! load-file (fn* (f) (eval (read-string (str "(do " (slurp f) "\nnil)")))))`,
 }
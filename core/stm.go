@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/types"
+)
+
+// assertRef asserts that `arg` is a ref
+func assertRef(arg types.MalType) (*types.MalRef, error) {
+	ref, ok := arg.(*types.MalRef)
+	if !ok {
+		return nil, fmt.Errorf("incorrect arguments type: ref is expected")
+	}
+	return ref, nil
+}
+
+// assertAgent asserts that `arg` is an agent
+func assertAgent(arg types.MalType) (*types.MalAgent, error) {
+	agent, ok := arg.(*types.MalAgent)
+	if !ok {
+		return nil, fmt.Errorf("incorrect arguments type: agent is expected")
+	}
+	return agent, nil
+}
+
+// runningTxn returns the transaction of ctx or fails when `name` is called outside of dosync
+func runningTxn(ctx context.Context, name string) (*types.Txn, error) {
+	txn := types.TxnFrom(ctx)
+	if txn == nil {
+		return nil, fmt.Errorf("%s: %v", name, types.ErrNoTxn)
+	}
+	return txn, nil
+}
+
+func createRef(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	return types.NewRef(args[0]), nil
+}
+
+// refUpdate parses the arguments of alter and commute, (f ref-value args...) is the new value
+func refUpdate(ctx context.Context, name string, args []types.MalType) (*types.Txn, *types.MalRef, func(types.MalType) (types.MalType, error), error) {
+	if len(args) < 2 {
+		return nil, nil, nil, fmt.Errorf("incorrect number of arguments: expect at least 2 but get %d", len(args))
+	}
+	ref, err := assertRef(args[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	txn, err := runningTxn(ctx, name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f := func(old types.MalType) (types.MalType, error) {
+		return types.CallContext(ctx, args[1], append(types.MalList{old}, args[2:]...)...)
+	}
+	return txn, ref, f, nil
+}
+
+func alter(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	txn, ref, f, err := refUpdate(ctx, "alter", args)
+	if err != nil {
+		return nil, err
+	}
+	return txn.Alter(ref, f)
+}
+
+func commute(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	txn, ref, f, err := refUpdate(ctx, "commute", args)
+	if err != nil {
+		return nil, err
+	}
+	return txn.Commute(ref, f)
+}
+
+func refSet(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 2); err != nil {
+		return nil, err
+	}
+	ref, err := assertRef(args[0])
+	if err != nil {
+		return nil, err
+	}
+	txn, err := runningTxn(ctx, "ref-set")
+	if err != nil {
+		return nil, err
+	}
+	return txn.Alter(ref, func(types.MalType) (types.MalType, error) {
+		return args[1], nil
+	})
+}
+
+func ensure(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	ref, err := assertRef(args[0])
+	if err != nil {
+		return nil, err
+	}
+	txn, err := runningTxn(ctx, "ensure")
+	if err != nil {
+		return nil, err
+	}
+	return txn.Ensure(ref)
+}
+
+// derefRef reads the ref in the running transaction, or its latest value outside of any
+func derefRef(ctx context.Context, ref *types.MalRef) (types.MalType, error) {
+	if txn := types.TxnFrom(ctx); txn != nil {
+		return txn.Read(ref)
+	}
+	return ref.Deref(), nil
+}
+
+func createAgent(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	return types.NewAgent(args[0]), nil
+}
+
+// send sets the state of the agent to (f state args...) asynchronously, inside a transaction
+// the action is only sent once the transaction commits
+func send(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("incorrect number of arguments: expect at least 2 but get %d", len(args))
+	}
+	agent, err := assertAgent(args[0])
+	if err != nil {
+		return nil, err
+	}
+	// actions run on their own goroutine, out of the transaction and of the evaluation sending them
+	action := func(state types.MalType) (types.MalType, error) {
+		return types.CallContext(context.Background(), args[1], append(types.MalList{state}, args[2:]...)...)
+	}
+	if txn := types.TxnFrom(ctx); txn != nil {
+		txn.Send(func() {
+			_ = agent.Send(action)
+		})
+		return agent, nil
+	}
+	if err := agent.Send(action); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// await blocks until the actions sent to the agents so far are done
+func await(ctx context.Context, args ...types.MalType) (types.MalType, error) {
+	if types.TxnFrom(ctx) != nil {
+		return nil, fmt.Errorf("can't await in a transaction")
+	}
+	for _, arg := range args {
+		agent, err := assertAgent(arg)
+		if err != nil {
+			return nil, err
+		}
+		if err := agent.Await(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return types.MalNil, nil
+}
+
+func agentError(args ...types.MalType) (types.MalType, error) {
+	if err := AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	agent, err := assertAgent(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := agent.Error(); err != nil {
+		return types.MalString{Value: err.Error()}, nil
+	}
+	return types.MalNil, nil
+}
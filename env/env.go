@@ -4,53 +4,180 @@ import (
 	"fmt"
 	"github.com/jiayouxujin/mal-go/core"
 	"github.com/jiayouxujin/mal-go/types"
+	"sync"
+	"sync/atomic"
 )
 
+type bindings = map[int]types.MalType
+
+//Env is safe for concurrent use, e.g. by `def!` from several goroutines
+//the bindings are copied on write so that lookups never lock
+//the locals of functions and let* are kept in slots, which the evaluator resolves ahead of time
 type Env struct {
-	outer types.MalEnv
-	data  map[string]types.MalType
+	//version counts the bindings set, slots aside, it's first to be aligned for atomic access
+	version uint64
+	outer   *Env
+	names   []int           // symbol ids of the slots
+	slots   []types.MalType // nil until bound
+	mu      sync.Mutex      // serializes writers
+	data    atomic.Value
+	//redefined holds the ids of the symbols bound more than once, copied on write too
+	redefined atomic.Value
+}
+
+//NewFrame returns an env with a slot for each of names, see SetSlot
+func NewFrame(outer *Env, names []int) *Env {
+	return &Env{outer: outer, names: names, slots: make([]types.MalType, len(names))}
+}
+
+//bindings returns the bindings which aren't in slots, they must not be changed
+func (e *Env) bindings() bindings {
+	data, _ := e.data.Load().(bindings)
+	return data
+}
+
+//slotOf returns the last slot bound to the symbol id
+func (e *Env) slotOf(id int) int {
+	for i := len(e.names) - 1; i >= 0; i-- {
+		if e.names[i] == id && e.slots[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+//SetSlot binds the value of slot i, slots are only set by the goroutine creating the env
+func (e *Env) SetSlot(i int, value types.MalType) {
+	e.slots[i] = value
+}
+
+//Slot returns the value of slot i of the env depth levels up the chain
+func (e *Env) Slot(depth, i int) types.MalType {
+	return e.Outer(depth).slots[i]
+}
+
+//Outer returns the env depth levels up the chain
+func (e *Env) Outer(depth int) *Env {
+	for ; depth > 0; depth-- {
+		e = e.outer
+	}
+	return e
 }
 
 //Set takes a symbol key and a mal value and adds to the data structure
+//the symbols bound to slots can't be set, other goroutines may read them without locking
 func (e *Env) Set(Key types.MalSymbol, value types.MalType) error {
 	if e == nil {
 		return fmt.Errorf("set value in nil environment")
 	}
-	e.data[Key.Value] = value
+	id := types.Intern(Key.Value)
+	if e.slotOf(id) >= 0 {
+		return fmt.Errorf("'%s' is a local, def! only binds globals", Key.Value)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := e.bindings()
+	if _, ok := old[id]; ok && !e.redefinedID(id) {
+		prev, _ := e.redefined.Load().(map[int]bool)
+		redefined := make(map[int]bool, len(prev)+1)
+		for k := range prev {
+			redefined[k] = true
+		}
+		redefined[id] = true
+		e.redefined.Store(redefined)
+	}
+	data := make(bindings, len(old)+1)
+	for k, v := range old {
+		data[k] = v
+	}
+	data[id] = value
+	e.data.Store(data)
+	atomic.AddUint64(&e.version, 1)
+	return nil
+}
+
+//Version changes whenever a symbol is bound in the env or its outer envs, slots aside
+//so the values looked up in them can be reused as long as it stays the same
+func (e *Env) Version() uint64 {
+	var v uint64
+	for ; e != nil; e = e.outer {
+		v += atomic.LoadUint64(&e.version)
+	}
+	return v
+}
+
+//Redefined reports whether the symbol was bound more than once in the env itself, slots aside
+func (e *Env) Redefined(key types.MalSymbol) bool {
+	return e.redefinedID(types.Intern(key.Value))
+}
+
+func (e *Env) redefinedID(id int) bool {
+	redefined, _ := e.redefined.Load().(map[int]bool)
+	return redefined[id]
+}
+
+//lookup returns the value bound to the symbol id in the env itself
+func (e *Env) lookup(id int) (types.MalType, bool) {
+	if i := e.slotOf(id); i >= 0 {
+		return e.slots[i], true
+	}
+	v, ok := e.bindings()[id]
+	return v, ok
+}
+
+//find returns the env binding the symbol id
+func (e *Env) find(id int) *Env {
+	for ; e != nil; e = e.outer {
+		if _, ok := e.lookup(id); ok {
+			return e
+		}
+	}
 	return nil
 }
 
 //Find takes a symbol key and if the current env contains that key then return the env
 //if no key is found and outer is not nil then call find on the outer env
 func (e *Env) Find(key types.MalSymbol) types.MalEnv {
-	if e == nil {
-		return nil
-	}
-	if _, ok := e.data[key.Value]; ok {
-		return e
-	} else if e.outer != nil {
-		return e.outer.Find(key)
-	} else {
-		return nil
+	if env := e.find(types.Intern(key.Value)); env != nil {
+		return env
 	}
+	return nil
 }
 
 //Get takes a symbol key and uses the find method to locate the env with the key,then return the matching the value
 func (e *Env) Get(key types.MalSymbol) (types.MalType, error) {
-	env := e.Find(key)
+	return e.GetID(types.Intern(key.Value))
+}
+
+//GetID is Get with an interned symbol
+func (e *Env) GetID(id int) (types.MalType, error) {
+	env := e.find(id)
 	if env == nil {
 		return nil, fmt.Errorf("not found")
-	} else {
-		return env.(*Env).data[key.Value], nil
 	}
+	v, _ := env.lookup(id)
+	return v, nil
 }
 
-func CreateEnv(outer types.MalEnv, binds types.MalList, exps types.MalList) (*Env, error) {
-	env := &Env{
-		outer: outer,
-		data:  make(map[string]types.MalType),
+//Symbols returns the names bound in the env and all of its outer envs
+func (e *Env) Symbols() []string {
+	var names []string
+	for cur := e; cur != nil; cur = cur.outer {
+		for i, id := range cur.names {
+			if cur.slots[i] != nil {
+				names = append(names, types.SymbolName(id))
+			}
+		}
+		for id := range cur.bindings() {
+			names = append(names, types.SymbolName(id))
+		}
 	}
+	return names
+}
 
+//CreateEnv binds the symbols of binds to exps in a new env, see BindArgs
+func CreateEnv(outer types.MalEnv, binds types.MalList, exps types.MalList) (*Env, error) {
+	parent, _ := outer.(*Env)
 	flag := false
 	for i, k := range binds {
 		symbol, ok := k.(types.MalSymbol)
@@ -65,27 +192,31 @@ func CreateEnv(outer types.MalEnv, binds types.MalList, exps types.MalList) (*En
 		}
 	}
 
-	if flag && len(binds)-2 > len(exps) {
+	names := make([]int, 0, len(binds))
+	for _, k := range binds {
+		if symbol := k.(types.MalSymbol); symbol.Value != "&" {
+			names = append(names, types.Intern(symbol.Value))
+		}
+	}
+	return BindArgs(parent, names, flag, exps)
+}
+
+//BindArgs binds exps to the slots named by the parameters of a function, the last one
+//takes the rest of exps if variadic
+//exps becomes the slots so it must not be changed afterwards
+func BindArgs(outer *Env, names []int, variadic bool, exps types.MalList) (*Env, error) {
+	if variadic && len(names)-1 > len(exps) {
 		return nil, fmt.Errorf("not enough expressions for a variadic function")
-	} else if !flag && len(binds) != len(exps) {
+	} else if !variadic && len(names) != len(exps) {
 		return nil, fmt.Errorf(
 			"different numbers of bindings and expressions for a non-variadic function")
 	}
-	for i, k := range binds {
-		if flag && i == len(binds)-2 {
-			continue
-		}
-		symbol, _ := k.(types.MalSymbol)
-		var v types.MalType
-		if flag && i == len(binds)-1 {
-			v = exps[i-1:]
-		} else {
-			v = exps[i]
-		}
-		err := env.Set(symbol, v)
-		if err != nil {
-			return nil, err
-		}
+	env := &Env{outer: outer, names: names, slots: exps}
+	if variadic {
+		// the rest of the arguments go to the last slot
+		env.slots = make([]types.MalType, len(names))
+		copy(env.slots, exps[:len(names)-1])
+		env.slots[len(names)-1] = exps[len(names)-1:]
 	}
 	return env, nil
 }
@@ -93,7 +224,19 @@ func CreateEnv(outer types.MalEnv, binds types.MalList, exps types.MalList) (*En
 func GetInitEnv() (e *Env) {
 	e, _ = CreateEnv(nil, nil, nil)
 	for k, v := range core.NameSpace {
-		err := e.Set(types.MalSymbol{Value: k}, v)
+		err := e.Set(types.MalSymbol{Value: k}, types.MalBuiltin{Name: k, Fn: v})
+		if err != nil {
+			return nil
+		}
+	}
+	for k, f := range core.CtxNameSpace {
+		err := e.Set(types.MalSymbol{Value: k}, types.MalBuiltin{Name: k, CtxFn: f})
+		if err != nil {
+			return nil
+		}
+	}
+	for k, f := range core.EnvNameSpace {
+		err := e.Set(types.MalSymbol{Value: k}, types.MalBuiltin{Name: k, Fn: f(e)})
 		if err != nil {
 			return nil
 		}
@@ -0,0 +1,155 @@
+package env_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jiayouxujin/mal-go/env"
+	"github.com/jiayouxujin/mal-go/mal"
+	"github.com/jiayouxujin/mal-go/types"
+)
+
+const (
+	goroutines = 16
+	rounds     = 200
+)
+
+func symbol(g, i int) types.MalSymbol {
+	return types.MalSymbol{Value: fmt.Sprintf("g%d-%d", g, i)}
+}
+
+// Get, Set and Symbols are called on one env from many goroutines, run with -race
+func TestConcurrentGetSet(t *testing.T) {
+	root := env.GetInitEnv()
+	e, err := env.CreateEnv(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := types.MalSymbol{Value: "shared"}
+	if err := e.Set(shared, types.MalNumber{Value: 0}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := e.Set(symbol(g, i), types.MalNumber{Value: i}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := e.Set(shared, types.MalNumber{Value: g}); err != nil {
+					t.Error(err)
+					return
+				}
+				if v, err := e.Get(symbol(g, i)); err != nil || v != (types.MalNumber{Value: i}) {
+					t.Errorf("Get %s = %v, %v", symbol(g, i).Value, v, err)
+					return
+				}
+				if _, err := e.Get(shared); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := e.Get(types.MalSymbol{Value: "+"}); err != nil {
+					t.Error(err)
+					return
+				}
+				if i%20 == 0 {
+					_ = e.Symbols()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < rounds; i++ {
+			if v, err := e.Get(symbol(g, i)); err != nil || v != (types.MalNumber{Value: i}) {
+				t.Fatalf("Get %s = %v, %v", symbol(g, i).Value, v, err)
+			}
+		}
+	}
+	if n := len(e.Symbols()); n < goroutines*rounds {
+		t.Fatalf("Symbols returns %d names, want at least %d", n, goroutines*rounds)
+	}
+}
+
+// def! evaluated on many goroutines, by Go callers and by futures, binds every name in the global env
+func TestConcurrentDef(t *testing.T) {
+	in := mal.New()
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < rounds/10; i++ {
+				src := fmt.Sprintf("(def! %s %d) %s", symbol(g, i).Value, i, symbol(g, i).Value)
+				if _, err := in.EvalString(context.Background(), src); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	futures := "(def! fs ["
+	for i := 0; i < goroutines; i++ {
+		futures += fmt.Sprintf(" (future (def! f%d %d))", i, i)
+	}
+	if _, err := in.EvalString(context.Background(), futures+"]) (pmap deref fs)"); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < rounds/10; i++ {
+			if v, err := in.Env().Get(symbol(g, i)); err != nil || v != (types.MalNumber{Value: i}) {
+				t.Fatalf("%s = %v, %v", symbol(g, i).Value, v, err)
+			}
+		}
+	}
+	for i := 0; i < goroutines; i++ {
+		f := types.MalSymbol{Value: fmt.Sprintf("f%d", i)}
+		if v, err := in.Env().Get(f); err != nil || v != (types.MalNumber{Value: i}) {
+			t.Fatalf("%s = %v, %v", f.Value, v, err)
+		}
+	}
+}
+
+// def! in functions and let* binds globals, goroutines started there share the locals
+// but can't set them
+func TestDefLocal(t *testing.T) {
+	for name, opts := range map[string][]mal.Option{"tree": nil, "vm": {mal.WithVM()}} {
+		t.Run(name, func(t *testing.T) {
+			in := mal.New(opts...)
+			futures := "(let* (x 1) (pmap deref ["
+			for i := 0; i < goroutines; i++ {
+				futures += fmt.Sprintf(" (future (def! h%d (+ x %d)))", i, i)
+			}
+			if _, err := in.EvalString(context.Background(), futures+"]))"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < goroutines; i++ {
+				h := types.MalSymbol{Value: fmt.Sprintf("h%d", i)}
+				if v, err := in.Env().Get(h); err != nil || v != (types.MalNumber{Value: i + 1}) {
+					t.Fatalf("%s = %v, %v", h.Value, v, err)
+				}
+			}
+			v, err := in.EvalString(context.Background(), "((fn* (a) (let* (b 2) (def! c (+ a b)))) 1) c")
+			if err != nil || v != (types.MalNumber{Value: 3}) {
+				t.Fatalf("c = %v, %v", v, err)
+			}
+			for _, src := range []string{
+				"(let* (x 1) (def! x 2))",
+				"((fn* (x) (def! x 2)) 1)",
+				"((fn* (x) ((fn* () (def! x 2)))) 1)",
+				"(let* (x 1) (deref (future (def! x 2))))",
+			} {
+				want := "'x' is a local, def! only binds globals"
+				if _, err := in.EvalString(context.Background(), src); err == nil || err.Error() != want {
+					t.Errorf("%s fails with %v, want %s", src, err, want)
+				}
+			}
+		})
+	}
+}
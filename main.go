@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"github.com/jiayouxujin/mal-go/core"
 	"github.com/jiayouxujin/mal-go/env"
+	"github.com/jiayouxujin/mal-go/mal"
 	"github.com/jiayouxujin/mal-go/printer"
 	"github.com/jiayouxujin/mal-go/reader"
 	"github.com/jiayouxujin/mal-go/readline"
 	. "github.com/jiayouxujin/mal-go/types"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
 )
 
 func READ(input string) (MalType, error) {
@@ -18,198 +25,75 @@ func READ(input string) (MalType, error) {
 	return ast, nil
 }
 
-func evalAst(ast MalType, env *env.Env) (MalType, error) {
-	switch t := ast.(type) {
-	case MalSymbol:
-		if fun, err := env.Get(t); err == nil {
-			return fun, nil
-		}
-		return nil, fmt.Errorf("failed to look up '%s' in environments", t.Value)
-	case MalList:
-		evaluatedList := make(MalList, 0)
-		for _, ori := range t {
-			if evaluated, err := EVAL(ori, env); err == nil {
-				evaluatedList = append(evaluatedList, evaluated)
-			} else {
-				return nil, err
-			}
-		}
-		return evaluatedList, nil
-	case MalVector:
-		evaluatedLIst, err := evalAst(MalList(t), env)
-		if err != nil {
-			return nil, err
-		}
-		return MalVector(evaluatedLIst.(MalList)), nil
-	case MalHashmap:
-		result := make(MalHashmap)
-		for k, v := range t {
-			v, err := EVAL(v, env)
-			if err != nil {
-				return nil, err
-			}
-			result[k] = v
-		}
-		return result, nil
-	default:
-		return ast, nil
-	}
-}
-func EVAL(ast MalType, e *env.Env) (MalType, error) {
-	switch t := ast.(type) {
-	case MalList:
-		if len(t) == 0 {
-			return t, nil //ast is empty list return ast unchanged
-		}
-		first := ""
-		if symbol, ok := t[0].(MalSymbol); ok {
-			first = symbol.Value
-		}
-		switch first {
-		case "def!":
-			if len(t) != 3 {
-				return nil, fmt.Errorf("incorrect number of parameters for 'def!'")
-			}
-			k, ok := t[1].(MalSymbol)
-			if !ok {
-				return nil, fmt.Errorf("the first parameter is expected to be a symbol")
-			}
-			v, err := EVAL(t[2], e)
-			if err != nil {
-				return nil, err
-			}
-			err = e.Set(k, v)
-			return v, err
-		case "let*":
-			if len(t) != 3 {
-				return nil, fmt.Errorf("incorrect number of arguments for 'let*'")
-			}
-			bindings, ok := t[1].(MalList)
-			if !ok || len(bindings)%2 != 0 {
-				return nil, fmt.Errorf("the first parameter is expected to be a list of even length")
-			}
-			tmpEnv, _ := env.CreateEnv(e, nil, nil)
-			for i := 0; i < len(bindings); i += 2 {
-				k, ok := bindings[i].(MalSymbol)
-				if !ok {
-					return nil, fmt.Errorf("invalid symbol(s) in variable bindings")
-				}
-				v, err := EVAL(bindings[i+1], tmpEnv)
-				if err != nil {
-					return nil, err
-				}
-				err = tmpEnv.Set(k, v)
-				if err != nil {
-					return nil, err
-				}
-			}
-			ast, e = t[2], tmpEnv
-			return EVAL(ast, e)
-		case "do":
-			var final MalType
-			var err error
-			for _, exp := range t[1:] {
-				final, err = EVAL(exp, e)
-				if err != nil {
-					return nil, err
-				}
-			}
-			return final, nil
-		case "if":
-			if len(t) == 3 {
-				t = append(t, MalNil)
-			} else if len(t) != 4 {
-				return nil, fmt.Errorf("incorrect number of arguments for 'if'")
-			}
-			condition, err := EVAL(t[1], e)
-			if err != nil {
-				return nil, err
-			}
-			if condition == MalFalse || condition == MalNil {
-				return EVAL(t[3], e)
-			}
-			return EVAL(t[2], e)
-		case "fn*":
-			if len(t) != 3 {
-				return nil, fmt.Errorf("incorret number of arguments for 'fn*'")
-			}
-			params, ok := t[1].(MalList)
-			if !ok {
-				return nil, fmt.Errorf("the first argument should be function parameter list")
-			}
-			for i, v := range params {
-				if _, ok := v.(MalSymbol); !ok {
-					return nil, fmt.Errorf("parameter %d is not a valid symbol", i)
-				}
-			}
-			closure := func(args ...MalType) (MalType, error) {
-				wrappedEnv, err := env.CreateEnv(e, params, args)
-				if err != nil {
-					return nil, err
-				}
-				return EVAL(t[2], wrappedEnv)
-			}
-			return MalFunctionTCO{
-				AST:      t[2],
-				Params:   params,
-				Env:      e,
-				Function: closure,
-			}, nil
-		default:
-			evaluatedList, err := evalAst(t, e)
-			if err != nil {
-				return nil, err
-			}
-			switch f := evaluatedList.(MalList)[0].(type) {
-			case MalFunction:
-				return f(evaluatedList.(MalList)[1:]...)
-			case MalFunctionTCO:
-				ast = f.AST
-				environment, err := env.CreateEnv(f.Env, f.Params, evaluatedList.(MalList)[1:])
-				if err != nil {
-					return nil, err
-				}
-				return EVAL(ast, environment)
-			default:
-				return nil, fmt.Errorf("invalid function calling")
-			}
-		}
-	default: //ast is not a list,call evalAst
-		return evalAst(ast, e)
+func PRINT(exp MalType, e *env.Env) (string, error) {
+	var sb strings.Builder
+	if err := printer.Fprint(&sb, exp, printer.OptionsFromEnv(e, true)); err != nil {
+		return "", err
 	}
+	return sb.String(), nil
 }
 
-func PRINT(exp MalType) (string, error) {
-	return printer.PrStr(exp, true), nil
-}
-
-func rep(input string, replEnv *env.Env) (MalType, error) {
+// rep returns the evaluated value along with its printed representation
+func rep(ctx context.Context, input string, in *mal.Interp) (MalType, string, error) {
 	var exp MalType
 	var res string
 	var e error
 	if exp, e = READ(input); e != nil {
-		return nil, e
+		return nil, "", e
 	}
-	if exp, e = EVAL(exp, replEnv); e != nil {
-		return nil, e
+	collectKeywords(exp)
+	if exp, e = in.Eval(ctx, exp); e != nil {
+		return nil, "", e
 	}
-	if res, e = PRINT(exp); e != nil {
-		return nil, e
+	if res, e = PRINT(exp, in.Env()); e != nil {
+		return nil, "", e
 	}
-	return res, nil
+	return exp, res, nil
 }
 
+var (
+	historyFile = flag.String("history", readline.DefaultHistoryFile(), "file to keep the REPL history in")
+	historySize = flag.Int("history-size", readline.DefaultHistorySize, "max number of entries kept in the history")
+	maxSteps    = flag.Int64("max-steps", 0, "max number of steps of each evaluation, 0 for no limit")
+	maxDepth    = flag.Int("max-depth", mal.DefaultMaxDepth, "max nesting depth of each evaluation, a negative value for no limit")
+	timeout     = flag.Duration("timeout", 0, "max wall time of each evaluation, 0 for no limit")
+	vm          = flag.Bool("vm", false, "run on the bytecode VM rather than the tree-walking evaluator")
+	optimize    = flag.Bool("optimize", false, "fold constants and inline small functions before evaluating forms")
+)
+
+// replLimits bounds every evaluation in the REPL
+var replLimits mal.Limits
+
 func main() {
+	flag.Parse()
+	replLimits = mal.Limits{MaxSteps: *maxSteps, MaxDepth: *maxDepth, Timeout: *timeout}
+	readline.Open(readline.Options{HistoryFile: *historyFile, HistorySize: *historySize})
 	defer readline.Close()
 
-	replEnv := env.GetInitEnv()
-	runInitCommands(replEnv)
-	for {
-		input, err := readline.PromptAndRead("user> ")
+	s := &session{in: newInterp(), ctx: context.Background()}
+	readline.SetCompleter(func(word string) []string {
+		return completeSymbol(s.in.Env(), word)
+	})
+	for !s.quit {
+		input, err := readline.PromptAndRead(s.in.Namespace() + "> ")
 		if err != nil {
 			break
 		}
-		res, err := rep(input, replEnv)
+		if cmd, arg, ok := parseCommand(input); ok {
+			interruptible(s, func() {
+				err = cmd.run(s, arg)
+			})
+			if err != nil {
+				fmt.Printf("%v\n", err)
+			}
+			continue
+		}
+		var v MalType
+		var res string
+		interruptible(s, func() {
+			v, res, err = rep(s.ctx, input, s.in)
+		})
+		s.record(v, err)
 		if err != nil {
 			fmt.Printf("%v\n", err)
 		} else {
@@ -218,8 +102,84 @@ func main() {
 	}
 }
 
-func runInitCommands(replEnv *env.Env) {
-	for _, command := range core.InitCommands {
-		_, _ = rep(command, replEnv)
+// interruptible runs f with s.ctx canceled by Ctrl-C, which interrupts the evaluation
+// rather than killing the REPL
+// s.ctx isn't canceled when f returns, so that goroutines spawned by `go` keep running
+func interruptible(s *session, f func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sigint:
+			cancel()
+		case <-done:
+		}
+	}()
+	s.ctx = ctx
+	defer func() {
+		signal.Stop(sigint)
+		close(done)
+		s.ctx = context.Background()
+	}()
+	f()
+}
+
+// newInterp creates the interpreter of the REPL and runs the startup file
+func newInterp() *mal.Interp {
+	opts := []mal.Option{mal.WithLimits(replLimits)}
+	if *vm {
+		opts = append(opts, mal.WithVM())
+	}
+	if *optimize {
+		opts = append(opts, mal.WithOptimizer())
+	}
+	// MALPATH lists the directories require looks for libs in
+	if path := os.Getenv("MALPATH"); path != "" {
+		opts = append(opts, mal.WithLoadPath(filepath.SplitList(path)...))
+	}
+	in := mal.New(opts...)
+	runInitFile(in)
+	for _, name := range historySymbols {
+		_ = in.Define(name, MalNil)
+	}
+	return in
+}
+
+// initFile returns the path of the startup file, mal/init.mal under $XDG_CONFIG_HOME
+func initFile() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "mal", "init.mal")
+}
+
+// runInitFile evaluates the startup file if it exists
+func runInitFile(in *mal.Interp) {
+	file := initFile()
+	if file == "" {
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		return
+	}
+	if err := loadFile(context.Background(), file, in); err != nil {
+		fmt.Printf("%s: %v\n", file, err)
+	}
+}
+
+// loadFile evaluates all forms in file
+func loadFile(ctx context.Context, file string, in *mal.Interp) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
 	}
+	_, err = in.EvalString(ctx, string(content))
+	return err
 }
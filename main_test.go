@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jiayouxujin/mal-go/mal"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+func TestRunInitFile(t *testing.T) {
+	dir := t.TempDir()
+	prev, ok := os.LookupEnv("XDG_CONFIG_HOME")
+	_ = os.Setenv("XDG_CONFIG_HOME", dir)
+	defer func() {
+		if ok {
+			_ = os.Setenv("XDG_CONFIG_HOME", prev)
+		} else {
+			_ = os.Unsetenv("XDG_CONFIG_HOME")
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(dir, "mal"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "mal", "init.mal"), []byte("(def! x 1)\n(def! y (+ x 1))\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	in := newInterp()
+	if v, err := in.Env().Get(MalSymbol{Value: "y"}); err != nil || v != (MalNumber{Value: 2}) {
+		t.Errorf("y = %v, %v after loading init.mal, want 2", v, err)
+	}
+}
+
+// SIGINT stops the running evaluation with ErrInterrupted instead of killing the process
+func TestInterruptible(t *testing.T) {
+	s := &session{in: newInterp(), ctx: context.Background()}
+	if _, _, err := rep(s.ctx, "(def! spin (fn* (n) (if (= n 0) 0 (do (spin (- n 1)) (spin (- n 1))))))", s.in); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	interruptible(s, func() {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			p, _ := os.FindProcess(os.Getpid())
+			_ = p.Signal(os.Interrupt)
+		}()
+		_, _, err = rep(s.ctx, "(spin 64)", s.in)
+	})
+	if err != mal.ErrInterrupted {
+		t.Fatalf("(spin 64) fails with %v, want %v", err, mal.ErrInterrupted)
+	}
+	var res string
+	interruptible(s, func() {
+		_, res, err = rep(s.ctx, "(+ 1 2)", s.in)
+	})
+	if err != nil || res != "3" {
+		t.Fatalf("(+ 1 2) = %s, %v after an interrupt", res, err)
+	}
+}
@@ -0,0 +1,512 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/env"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// node is a form compiled by the analyzer, it evaluates the form in an env
+// special forms are parsed and validated once by analyze rather than each time they are evaluated
+type node func(e *env.Env, st *evalState) (MalType, error)
+
+// lambda is the compiled body of a function, cached in MalFunctionTCO.Compiled
+// functions of several arities have a lambda for each
+type lambda struct {
+	names    []int
+	variadic bool
+	body     node
+	params   MalType
+	arities  []*lambda
+}
+
+// dispatch returns the lambda of l taking argc arguments
+func (l *lambda) dispatch(argc int) (*lambda, error) {
+	arities := l.arities
+	if arities == nil {
+		arities = []*lambda{l}
+	}
+	var rest *lambda
+	for _, a := range arities {
+		if !a.variadic && len(a.names) == argc {
+			return a, nil
+		} else if a.variadic && argc >= len(a.names)-1 {
+			rest = a
+		}
+	}
+	if rest != nil {
+		return rest, nil
+	}
+	params := make([]MalType, len(arities))
+	for i, a := range arities {
+		params[i] = a.params
+	}
+	return nil, arityError(params, argc)
+}
+
+// scope holds the names bound by the env the compiled code runs in, one scope per env
+// symbols bound by functions and let* are resolved to the slots of the envs up the chain
+type scope struct {
+	outer *scope
+	names []int
+}
+
+// lookup returns the depth and slot of the symbol id, or false if it's not bound by any scope
+func (s *scope) lookup(id int) (int, int, bool) {
+	for depth, cur := 0, s; cur != nil; depth, cur = depth+1, cur.outer {
+		for i := len(cur.names) - 1; i >= 0; i-- {
+			if cur.names[i] == id {
+				return depth, i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// failed returns a node reporting err, malformed forms only fail once they are evaluated
+func failed(err error) node {
+	return func(*env.Env, *evalState) (MalType, error) {
+		return nil, err
+	}
+}
+
+func constant(v MalType) node {
+	return func(*env.Env, *evalState) (MalType, error) {
+		return v, nil
+	}
+}
+
+// step makes n count as a step of the evaluation, which is checked against its limits
+func step(n node) node {
+	return func(e *env.Env, st *evalState) (MalType, error) {
+		if err := st.enter(); err != nil {
+			return nil, err
+		}
+		v, err := n(e, st)
+		st.leave()
+		return v, err
+	}
+}
+
+// analyze compiles ast to run in the envs described by s
+func (in *Interp) analyze(ast MalType, s *scope) node {
+	switch t := ast.(type) {
+	case MalSymbol:
+		return analyzeSymbol(t, s)
+	case qualified:
+		return func(*env.Env, *evalState) (MalType, error) {
+			return t.get()
+		}
+	case MalList:
+		if len(t) == 0 {
+			return constant(t) //ast is empty list return ast unchanged
+		}
+		if symbol, ok := t[0].(MalSymbol); ok {
+			if _, ok := SpecialForms[symbol.Value]; ok {
+				return step(in.analyzeSpecialForm(symbol.Value, t, s))
+			}
+		}
+		return step(in.analyzeApply(t, s))
+	case MalVector:
+		items := in.analyzeAll(MalList(t), s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			list, err := evalAll(items, e, st)
+			if err != nil {
+				return nil, err
+			}
+			return MalVector(list), nil
+		}
+	case MalHashmap:
+		items := make(map[MalType]node, len(t))
+		for k, v := range t {
+			items[k] = in.analyze(v, s)
+		}
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			result := make(MalHashmap, len(items))
+			for k, item := range items {
+				v, err := item(e, st)
+				if err != nil {
+					return nil, err
+				}
+				result[k] = v
+			}
+			return result, nil
+		}
+	default:
+		return constant(ast)
+	}
+}
+
+func analyzeSymbol(sym MalSymbol, s *scope) node {
+	id := Intern(sym.Value)
+	if depth, slot, ok := s.lookup(id); ok {
+		return func(e *env.Env, _ *evalState) (MalType, error) {
+			return e.Slot(depth, slot), nil
+		}
+	}
+	return func(e *env.Env, _ *evalState) (MalType, error) {
+		if v, err := e.GetID(id); err == nil {
+			return v, nil
+		}
+		return nil, fmt.Errorf("failed to look up '%s' in environments", sym.Value)
+	}
+}
+
+func (in *Interp) analyzeAll(list MalList, s *scope) []node {
+	nodes := make([]node, len(list))
+	for i, v := range list {
+		nodes[i] = in.analyze(v, s)
+	}
+	return nodes
+}
+
+// evalAll evaluates nodes in order
+func evalAll(nodes []node, e *env.Env, st *evalState) (MalList, error) {
+	list := make(MalList, len(nodes))
+	for i, n := range nodes {
+		v, err := n(e, st)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+// analyzeBody compiles exprs as the body of `do`
+func (in *Interp) analyzeBody(exprs MalList, s *scope) node {
+	if len(exprs) == 1 {
+		return in.analyze(exprs[0], s)
+	}
+	nodes := in.analyzeAll(exprs, s)
+	return func(e *env.Env, st *evalState) (MalType, error) {
+		var final MalType = MalNil
+		var err error
+		for _, n := range nodes {
+			final, err = n(e, st)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return final, nil
+	}
+}
+
+func (in *Interp) analyzeSpecialForm(name string, t MalList, s *scope) node {
+	switch name {
+	case "def!":
+		if len(t) != 3 {
+			return failed(fmt.Errorf("incorrect number of parameters for 'def!'"))
+		}
+		k, ok := t[1].(MalSymbol)
+		if !ok {
+			return failed(fmt.Errorf("the first parameter is expected to be a symbol"))
+		}
+		if _, _, ok := s.lookup(Intern(k.Value)); ok {
+			return failed(fmt.Errorf("'%s' is a local, def! only binds globals", k.Value))
+		}
+		// the global env is the one the envs of the enclosing functions and let* are made in
+		frames := 0
+		for cur := s; cur != nil; cur = cur.outer {
+			frames++
+		}
+		value := in.analyze(t[2], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			v, err := value(e, st)
+			if err != nil {
+				return nil, err
+			}
+			if f, ok := v.(MalFunctionTCO); ok && f.Name == "" {
+				f.Name = k.Value
+				v = f
+			}
+			err = e.Outer(frames).Set(k, v)
+			return v, err
+		}
+	case "let*":
+		if len(t) != 3 {
+			return failed(fmt.Errorf("incorrect number of arguments for 'let*'"))
+		}
+		bindings, ok := t[1].(MalList)
+		if !ok || len(bindings)%2 != 0 {
+			return failed(fmt.Errorf("the first parameter is expected to be a list of even length"))
+		}
+		bindings, err := destructureBindings(bindings)
+		if err != nil {
+			return failed(err)
+		}
+		inner := &scope{outer: s}
+		values := make([]node, len(bindings)/2)
+		var limits []int
+		for i := 0; i < len(bindings); i += 2 {
+			k, ok := bindings[i].(MalSymbol)
+			if !ok {
+				return failed(fmt.Errorf("invalid symbol(s) in variable bindings"))
+			}
+			// a binding only sees the ones before it
+			values[i/2] = in.analyze(bindings[i+1], inner)
+			inner.names = append(inner.names, Intern(k.Value))
+			if isPrintLimit(k) {
+				limits = append(limits, i/2)
+			}
+		}
+		body := in.analyze(t[2], inner)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			tmpEnv := env.NewFrame(e, inner.names)
+			for i, value := range values {
+				v, err := value(tmpEnv, st)
+				if err != nil {
+					return nil, err
+				}
+				tmpEnv.SetSlot(i, v)
+			}
+			if limits == nil {
+				return body(tmpEnv, st)
+			}
+			outer := st.printLimits
+			for _, i := range limits {
+				name := bindings[2*i].(MalSymbol).Value
+				st.printLimits = &printLimit{name: name, value: tmpEnv.Slot(0, i), outer: st.printLimits}
+			}
+			v, err := body(tmpEnv, st)
+			st.printLimits = outer
+			return v, err
+		}
+	case "loop":
+		if len(t) < 2 {
+			return failed(fmt.Errorf("incorrect number of arguments for 'loop'"))
+		}
+		bindings, ok := listOf(t[1])
+		if !ok || len(bindings)%2 != 0 {
+			return failed(fmt.Errorf("the first parameter is expected to be a list of even length"))
+		}
+		if expanded, err := destructureLoop(t, bindings); err != nil {
+			return failed(err)
+		} else if expanded != nil {
+			return in.analyzeSpecialForm("let*", expanded, s)
+		}
+		inner := &scope{outer: s}
+		values := make([]node, len(bindings)/2)
+		for i := 0; i < len(bindings); i += 2 {
+			k, ok := bindings[i].(MalSymbol)
+			if !ok {
+				return failed(fmt.Errorf("invalid symbol(s) in variable bindings"))
+			}
+			values[i/2] = in.analyze(bindings[i+1], inner)
+			inner.names = append(inner.names, Intern(k.Value))
+		}
+		body := in.analyzeBody(t[2:], inner)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			frame := env.NewFrame(e, inner.names)
+			for i, value := range values {
+				v, err := value(frame, st)
+				if err != nil {
+					return nil, err
+				}
+				frame.SetSlot(i, v)
+			}
+			for {
+				v, err := body(frame, st)
+				args, ok := v.(recurArgs)
+				if err != nil || !ok {
+					return v, err
+				}
+				// each iteration gets its own frame, closures keep the bindings they saw
+				frame = env.NewFrame(e, inner.names)
+				for i, arg := range args {
+					frame.SetSlot(i, arg)
+				}
+			}
+		}
+	case "recur":
+		args := in.analyzeAll(t[1:], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			args, err := evalAll(args, e, st)
+			if err != nil {
+				return nil, err
+			}
+			return recurArgs(args), nil
+		}
+	case "do":
+		return in.analyzeBody(t[1:], s)
+	case "if":
+		if len(t) == 3 {
+			t = append(t, MalNil)
+		} else if len(t) != 4 {
+			return failed(fmt.Errorf("incorrect number of arguments for 'if'"))
+		}
+		condition, then, otherwise := in.analyze(t[1], s), in.analyze(t[2], s), in.analyze(t[3], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			c, err := condition(e, st)
+			if err != nil {
+				return nil, err
+			}
+			if c == MalFalse || c == MalNil {
+				return otherwise(e, st)
+			}
+			return then(e, st)
+		}
+	case "fn*":
+		if clauses, ok := arityClauses(t); ok {
+			if err := checkArities(clauses); err != nil {
+				return failed(err)
+			}
+			l := &lambda{arities: make([]*lambda, len(clauses))}
+			arities := make([]MalVector, len(clauses))
+			for i, clause := range clauses {
+				c := clause.(MalList)
+				arities[i] = c[0].(MalVector)
+				arity, err := in.analyzeLambda(MalList(arities[i]), arities[i], c[1], s)
+				if err != nil {
+					return failed(err)
+				}
+				l.arities[i] = arity
+			}
+			return in.makeFunction(l, MalFunctionTCO{AST: clauses, Arities: arities})
+		}
+		if len(t) != 3 {
+			return failed(fmt.Errorf("incorret number of arguments for 'fn*'"))
+		}
+		params, ok := t[1].(MalList)
+		if !ok {
+			return failed(fmt.Errorf("the first argument should be function parameter list"))
+		}
+		l, err := in.analyzeLambda(params, params, t[2], s)
+		if err != nil {
+			return failed(err)
+		}
+		return in.makeFunction(l, MalFunctionTCO{AST: t[2], Params: params})
+	case "go":
+		body := in.analyzeBody(t[1:], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			ch := NewChannel(1)
+			child := st.fork()
+			go func() {
+				defer ch.Close()
+				v, err := body(e, child)
+				goResult(ch, child, v, err)
+			}()
+			return ch, nil
+		}
+	case "future":
+		body := in.analyzeBody(t[1:], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			f := NewFuture()
+			child := st.fork()
+			go func() {
+				v, err := body(e, child)
+				if v == nil {
+					v = MalNil
+				}
+				f.Deliver(v, err)
+			}()
+			return f, nil
+		}
+	case "dosync":
+		body := in.analyzeBody(t[1:], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			if TxnFrom(st.ctx) != nil { // nested transactions join the running one
+				return body(e, st)
+			}
+			return RunTxn(func(txn *Txn) (MalType, error) {
+				return body(e, st.withContext(WithTxn(st.ctx, txn)))
+			})
+		}
+	case ".":
+		if len(t) < 3 {
+			return failed(fmt.Errorf("incorrect number of arguments for '.'"))
+		}
+		name, err := memberName(t[2])
+		if err != nil {
+			return failed(err)
+		}
+		args := in.analyzeAll(append(MalList{t[1]}, t[3:]...), s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			args, err := evalAll(args, e, st)
+			if err != nil {
+				return nil, err
+			}
+			return CallMethod(args[0], name, args[1:]...)
+		}
+	case "ns", "in-ns", "require":
+		return func(_ *env.Env, st *evalState) (MalType, error) {
+			return in.namespaceForm(t, st)
+		}
+	case ".-":
+		if len(t) != 3 {
+			return failed(fmt.Errorf("incorrect number of arguments for '.-'"))
+		}
+		name, err := memberName(t[2])
+		if err != nil {
+			return failed(err)
+		}
+		obj := in.analyze(t[1], s)
+		return func(e *env.Env, st *evalState) (MalType, error) {
+			v, err := obj(e, st)
+			if err != nil {
+				return nil, err
+			}
+			return GetField(v, name)
+		}
+	default:
+		return failed(fmt.Errorf("unknown special form '%s'", name))
+	}
+}
+
+// analyzeLambda compiles a function taking params, shown as written in arity errors
+func (in *Interp) analyzeLambda(params MalList, written MalType, body MalType, s *scope) (*lambda, error) {
+	names, body, err := destructureParams(params, body)
+	if err != nil {
+		return nil, err
+	}
+	l := &lambda{params: written}
+	for i, v := range names {
+		symbol, ok := v.(MalSymbol)
+		if !ok {
+			return nil, fmt.Errorf("parameter %d is not a valid symbol", i)
+		}
+		if symbol.Value != "&" {
+			l.names = append(l.names, Intern(symbol.Value))
+		} else if i != len(params)-2 {
+			return nil, fmt.Errorf("invalid position for '&' in bindings")
+		} else {
+			l.variadic = true
+		}
+	}
+	l.body = in.analyze(body, &scope{outer: s, names: l.names})
+	return l, nil
+}
+
+// makeFunction returns a node creating f, a function running l, in the env it's evaluated in
+func (in *Interp) makeFunction(l *lambda, f MalFunctionTCO) node {
+	f.Compiled = l
+	return func(e *env.Env, st *evalState) (MalType, error) {
+		fn := f
+		fn.Env = e
+		fn.CtxFn = func(ctx context.Context, args ...MalType) (MalType, error) {
+			// args belongs to the caller
+			args = append(MalList(nil), args...)
+			return in.callback(ctx, func(st *evalState) (MalType, error) {
+				return in.call(l, e, args, st)
+			})
+		}
+		return fn, nil
+	}
+}
+
+// analyzeApply compiles a function call
+func (in *Interp) analyzeApply(t MalList, s *scope) node {
+	fn, args := in.analyze(t[0], s), in.analyzeAll(t[1:], s)
+	return func(e *env.Env, st *evalState) (MalType, error) {
+		f, err := fn(e, st)
+		if err != nil {
+			return nil, err
+		}
+		evaluated, err := evalAll(args, e, st)
+		if err != nil {
+			return nil, err
+		}
+		return in.apply(f, evaluated, st)
+	}
+}
@@ -0,0 +1,79 @@
+package mal
+
+import (
+	"fmt"
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+	"strings"
+)
+
+// arityClauses returns the clauses of a function of several arities, (fn* ([x] body) ([x y] body))
+// every clause is a list starting with a vector of parameters
+func arityClauses(t MalList) (MalList, bool) {
+	if len(t) < 2 {
+		return nil, false
+	}
+	for _, clause := range t[1:] {
+		c, ok := clause.(MalList)
+		if !ok || len(c) == 0 {
+			return nil, false
+		}
+		if _, ok := c[0].(MalVector); !ok {
+			return nil, false
+		}
+	}
+	return t[1:], true
+}
+
+// arityOf returns the number of parameters a clause takes, not counting the rest one
+func arityOf(params MalVector) (int, bool) {
+	for i, p := range params {
+		if p == ampersand {
+			return i, true
+		}
+	}
+	return len(params), false
+}
+
+// checkArities checks that a call with any number of arguments matches one clause at most
+func checkArities(clauses MalList) error {
+	fixed := make(map[int]bool, len(clauses))
+	variadic := -1
+	for _, clause := range clauses {
+		c := clause.(MalList)
+		if len(c) != 2 {
+			return fmt.Errorf("incorrect number of arguments for the arity %s of 'fn*'",
+				printer.PrStr(c[0], true))
+		}
+		n, rest := arityOf(c[0].(MalVector))
+		switch {
+		case rest && variadic >= 0:
+			return fmt.Errorf("a function can't have more than one variadic arity")
+		case rest:
+			variadic = n
+		case fixed[n]:
+			return fmt.Errorf("a function can't have two arities taking %d arguments", n)
+		default:
+			fixed[n] = true
+		}
+	}
+	for n := range fixed {
+		if variadic >= 0 && n > variadic {
+			return fmt.Errorf("a function can't have an arity taking more arguments than its variadic one")
+		}
+	}
+	return nil
+}
+
+// arityError reports a call with argc arguments matching none of the parameter lists of a function
+func arityError(arities []MalType, argc int) error {
+	takes := make([]string, len(arities))
+	for i, params := range arities {
+		takes[i] = printer.PrStr(params, true)
+	}
+	expected := takes[len(takes)-1]
+	if len(takes) > 1 {
+		expected = strings.Join(takes[:len(takes)-1], ", ") + " or " + expected
+	}
+	return fmt.Errorf("wrong number of arguments (%d) for a function taking %s", argc, expected)
+}
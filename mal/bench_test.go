@@ -0,0 +1,32 @@
+package mal
+
+import (
+	"context"
+	"testing"
+)
+
+// benchmark evaluates call with EvalString, once def is evaluated
+func benchmark(b *testing.B, def, call string) {
+	in := New()
+	if _, err := in.EvalString(context.Background(), def); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := in.EvalString(context.Background(), call); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFib is dominated by function calls and lookups of locals and globals
+func BenchmarkFib(b *testing.B) {
+	benchmark(b, "(def! fib (fn* (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))))", "(fib 20)")
+}
+
+// BenchmarkSum is dominated by special forms, which are parsed once when the form is analyzed
+func BenchmarkSum(b *testing.B) {
+	benchmark(b, "(def! sum (fn* (n acc) (let* (m (- n 1)) (if (= n 0) acc (do (sum m (+ acc n)))))))",
+		"(sum 1000 0)")
+}
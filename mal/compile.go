@@ -0,0 +1,525 @@
+package mal
+
+import (
+	"fmt"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// opcode is an instruction of the bytecode VM, its operands are 16 bits each
+type opcode byte
+
+const (
+	opConst        opcode = iota // k: push consts[k]
+	opGlobal                     // g: push the global globals[g]
+	opDefGlobal                  // g: bind the global globals[g] to the top of the stack
+	opLocal                      // s: push slot s
+	opSetLocal                   // s: set slot s to the top of the stack
+	opBoxed                      // s: push the value boxed in slot s
+	opSetBoxed                   // s: set the value boxed in slot s to the top of the stack
+	opBox                        // s: box the value of slot s, for parameters captured by closures
+	opNewBox                     // s: put an empty box in slot s, for let* bindings captured by closures
+	opNop                        // s: placeholder of opBox and opNewBox
+	opUpvalue                    // u: push the value of upvalue u
+	opName                       // k: name the function on top of the stack consts[k] unless it's named
+	opPop                        // drop the top of the stack
+	opJump                       // a: jump to a
+	opJumpIfFalse                // a: pop and jump to a if it's false or nil
+	opRecur                      // a: jump back to a, counting a step of the evaluation
+	opClosure                    // p: push a function of protos[p]
+	opArities                    // p n: push a function of the n arities protos[p] to protos[p+n-1]
+	opCall                       // n: call the function below the n arguments on top of the stack
+	opTailCall                   // n: like opCall, but the callee replaces the frame of the caller
+	opReturn                     // return the top of the stack
+	opVector                     // n: push a vector of the n values on top of the stack
+	opHashmap                    // n: push a hash-map of the n keys and values on top of the stack
+	opGo                         // p: run protos[p] on another goroutine and push its channel
+	opFuture                     // p: run protos[p] on another goroutine and push its future
+	opDosync                     // p: run protos[p] in a transaction
+	opMethod                     // k n: call method consts[k] of the object below the n arguments
+	opField                      // k: push field consts[k] of the object on top of the stack
+	opFail                       // k: fail with the message consts[k]
+	opQualified                  // k: push the global of another namespace named by consts[k]
+	opNamespace                  // k: evaluate consts[k], which is ns, in-ns or require
+	opBindLimit                  // k: pop and bind the print limit consts[k] to it, see printLimit
+	opUnbindLimits               // n: drop the n print limits bound last
+)
+
+// maxOperand bounds constants, slots, jumps and argument counts of a function
+const maxOperand = 1<<16 - 1
+
+// proto is a function compiled to bytecode
+type proto struct {
+	params   MalList
+	ast      MalType
+	nparams  int
+	variadic bool
+	nslots   int
+	code     []byte
+	consts   []MalType
+	globals  []MalSymbol
+	ids      []int // interned ids of globals
+	protos   []*proto
+	upvalues []upvalueRef
+}
+
+// upvalueRef tells where a closure finds a variable of the functions it's nested in
+type upvalueRef struct {
+	local bool // a slot of the enclosing function rather than one of its upvalues
+	index int
+	name  MalSymbol
+}
+
+// local is a variable kept in a slot of the frame
+// slots captured by closures hold a box shared with them instead of the value
+type local struct {
+	id       int
+	slot     int
+	pending  bool // bound by let* but not evaluated yet
+	captured bool
+	boxAt    int    // position of the placeholder boxing the slot
+	boxOp    opcode // the instruction replacing the placeholder once captured
+	reboxAt  []int  // positions of the placeholders putting a new box in the slot before recur
+	refs     []int  // positions of the instructions reading or setting the slot
+}
+
+// recurTarget is the loop or function recur jumps back to
+type recurTarget struct {
+	start  int
+	locals []*local
+	bound  int // the print limits bound at start
+}
+
+// compiler compiles a function, its locals are kept in scope order
+type compiler struct {
+	outer  *compiler
+	p      *proto
+	locals []*local
+	target *recurTarget
+	bound  int // the print limits bound by the enclosing let* of the function
+}
+
+// compile compiles ast as the body of a function without parameters
+func compile(ast MalType) *proto {
+	c := &compiler{p: &proto{ast: ast}}
+	c.compile(ast, true)
+	c.emit(opReturn)
+	return c.p
+}
+
+func (c *compiler) emit(op opcode, operands ...int) int {
+	pos := len(c.p.code)
+	c.p.code = append(c.p.code, byte(op))
+	for _, operand := range operands {
+		if operand > maxOperand {
+			panic(fmt.Errorf("function too large to compile"))
+		}
+		c.p.code = append(c.p.code, byte(operand>>8), byte(operand))
+	}
+	return pos
+}
+
+// patch sets the first operand of the instruction at pos
+func (c *compiler) patch(pos, operand int) {
+	c.p.code[pos+1], c.p.code[pos+2] = byte(operand>>8), byte(operand)
+}
+
+func (c *compiler) constant(v MalType) int {
+	c.p.consts = append(c.p.consts, v)
+	return len(c.p.consts) - 1
+}
+
+func (c *compiler) global(sym MalSymbol) int {
+	for i, g := range c.p.globals {
+		if g == sym {
+			return i
+		}
+	}
+	c.p.globals = append(c.p.globals, sym)
+	c.p.ids = append(c.p.ids, Intern(sym.Value))
+	return len(c.p.globals) - 1
+}
+
+// fail compiles a form which fails once it's evaluated, like the tree-walking evaluator does
+func (c *compiler) fail(err error) {
+	c.emit(opFail, c.constant(MalString{Value: err.Error()}))
+}
+
+// declare adds a local in the next slot
+func (c *compiler) declare(sym MalSymbol, boxOp opcode) *local {
+	l := &local{id: Intern(sym.Value), slot: len(c.locals), boxOp: boxOp}
+	l.boxAt = c.emit(opNop, l.slot)
+	c.locals = append(c.locals, l)
+	if len(c.locals) > c.p.nslots {
+		c.p.nslots = len(c.locals)
+	}
+	return l
+}
+
+// endScope drops the locals declared after the first n, boxing the captured ones
+func (c *compiler) endScope(n int) {
+	for _, l := range c.locals[n:] {
+		if !l.captured {
+			continue
+		}
+		c.p.code[l.boxAt] = byte(l.boxOp)
+		for _, pos := range l.reboxAt {
+			c.p.code[pos] = byte(opNewBox)
+		}
+		for _, pos := range l.refs {
+			if opcode(c.p.code[pos]) == opLocal {
+				c.p.code[pos] = byte(opBoxed)
+			} else {
+				c.p.code[pos] = byte(opSetBoxed)
+			}
+		}
+	}
+	c.locals = c.locals[:n]
+}
+
+func (c *compiler) emitLocal(op opcode, l *local) {
+	l.refs = append(l.refs, c.emit(op, l.slot))
+}
+
+func (c *compiler) resolveLocal(id int, pending bool) *local {
+	for i := len(c.locals) - 1; i >= 0; i-- {
+		if l := c.locals[i]; l.id == id && (pending || !l.pending) {
+			return l
+		}
+	}
+	return nil
+}
+
+// resolveUpvalue returns the upvalue of a local of the enclosing functions, or -1
+func (c *compiler) resolveUpvalue(sym MalSymbol, id int, pending bool) int {
+	if c.outer == nil {
+		return -1
+	}
+	if l := c.outer.resolveLocal(id, pending); l != nil {
+		l.captured = true
+		return c.addUpvalue(upvalueRef{local: true, index: l.slot, name: sym})
+	}
+	if u := c.outer.resolveUpvalue(sym, id, pending); u >= 0 {
+		return c.addUpvalue(upvalueRef{index: u, name: sym})
+	}
+	return -1
+}
+
+func (c *compiler) addUpvalue(ref upvalueRef) int {
+	for i, u := range c.p.upvalues {
+		if u.local == ref.local && u.index == ref.index {
+			return i
+		}
+	}
+	c.p.upvalues = append(c.p.upvalues, ref)
+	return len(c.p.upvalues) - 1
+}
+
+// symbol compiles a variable reference
+// closures also see the let* bindings which aren't evaluated yet, as the envs of the
+// tree-walking evaluator do, they are looked up as globals until they are bound
+func (c *compiler) symbol(sym MalSymbol) {
+	id := Intern(sym.Value)
+	if l := c.resolveLocal(id, false); l != nil {
+		c.emitLocal(opLocal, l)
+	} else if u := c.resolveUpvalue(sym, id, false); u >= 0 {
+		c.emit(opUpvalue, u)
+	} else if u := c.resolveUpvalue(sym, id, true); u >= 0 {
+		c.emit(opUpvalue, u)
+	} else {
+		c.emit(opGlobal, c.global(sym))
+	}
+}
+
+func (c *compiler) compile(ast MalType, tail bool) {
+	switch t := ast.(type) {
+	case MalSymbol:
+		c.symbol(t)
+	case qualified:
+		c.emit(opQualified, c.constant(t))
+	case MalList:
+		if len(t) == 0 {
+			c.emit(opConst, c.constant(t))
+			return
+		}
+		if symbol, ok := t[0].(MalSymbol); ok {
+			if _, ok := SpecialForms[symbol.Value]; ok {
+				c.specialForm(symbol.Value, t, tail)
+				return
+			}
+		}
+		for _, v := range t {
+			c.compile(v, false)
+		}
+		if tail {
+			c.emit(opTailCall, len(t)-1)
+		} else {
+			c.emit(opCall, len(t)-1)
+		}
+	case MalVector:
+		for _, v := range t {
+			c.compile(v, false)
+		}
+		c.emit(opVector, len(t))
+	case MalHashmap:
+		for k, v := range t {
+			c.emit(opConst, c.constant(k))
+			c.compile(v, false)
+		}
+		c.emit(opHashmap, len(t))
+	default:
+		c.emit(opConst, c.constant(ast))
+	}
+}
+
+// body compiles exprs as the body of `do`
+func (c *compiler) body(exprs MalList, tail bool) {
+	if len(exprs) == 0 {
+		c.emit(opConst, c.constant(MalNil))
+		return
+	}
+	for i, expr := range exprs {
+		if i > 0 {
+			c.emit(opPop)
+		}
+		c.compile(expr, tail && i == len(exprs)-1)
+	}
+}
+
+// function compiles a nested function and returns its index in protos
+func (c *compiler) function(params MalList, body MalList) int {
+	inner := &compiler{outer: c, p: &proto{params: params, ast: body[0]}}
+	for _, p := range params {
+		if symbol := p.(MalSymbol); symbol.Value == "&" {
+			inner.p.variadic = true
+		} else {
+			inner.declare(symbol, opBox)
+		}
+	}
+	inner.p.nparams = len(inner.locals)
+	inner.target = &recurTarget{start: len(inner.p.code), locals: inner.locals}
+	inner.body(body, true)
+	inner.endScope(0)
+	inner.emit(opReturn)
+	c.p.protos = append(c.p.protos, inner.p)
+	return len(c.p.protos) - 1
+}
+
+// lambda compiles a function taking params and returns its index in protos
+func (c *compiler) lambda(params MalList, body MalType) (int, error) {
+	names, expanded, err := destructureParams(params, body)
+	if err != nil {
+		return 0, err
+	}
+	for i, v := range names {
+		symbol, ok := v.(MalSymbol)
+		if !ok {
+			return 0, fmt.Errorf("parameter %d is not a valid symbol", i)
+		}
+		if symbol.Value == "&" && i != len(params)-2 {
+			return 0, fmt.Errorf("invalid position for '&' in bindings")
+		}
+	}
+	i := c.function(names, MalList{expanded})
+	// functions print the parameters they were written with
+	c.p.protos[i].params, c.p.protos[i].ast = params, body
+	return i, nil
+}
+
+func (c *compiler) specialForm(name string, t MalList, tail bool) {
+	switch name {
+	case "def!":
+		if len(t) != 3 {
+			c.fail(fmt.Errorf("incorrect number of parameters for 'def!'"))
+			return
+		}
+		k, ok := t[1].(MalSymbol)
+		if !ok {
+			c.fail(fmt.Errorf("the first parameter is expected to be a symbol"))
+			return
+		}
+		id := Intern(k.Value)
+		if c.resolveLocal(id, false) != nil || c.resolveUpvalue(k, id, false) >= 0 {
+			c.fail(fmt.Errorf("'%s' is a local, def! only binds globals", k.Value))
+			return
+		}
+		c.compile(t[2], false)
+		c.emit(opName, c.constant(k))
+		c.emit(opDefGlobal, c.global(k))
+	case "let*", "loop":
+		if name == "let*" && len(t) != 3 || len(t) < 2 {
+			c.fail(fmt.Errorf("incorrect number of arguments for '%s'", name))
+			return
+		}
+		bindings, ok := t[1].(MalList)
+		if name == "loop" {
+			bindings, ok = listOf(t[1])
+		}
+		if !ok || len(bindings)%2 != 0 {
+			c.fail(fmt.Errorf("the first parameter is expected to be a list of even length"))
+			return
+		}
+		var err error
+		if name == "loop" {
+			var expanded MalList
+			if expanded, err = destructureLoop(t, bindings); expanded != nil {
+				c.specialForm("let*", expanded, tail)
+				return
+			}
+		} else {
+			bindings, err = destructureBindings(bindings)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		for i := 0; i < len(bindings); i += 2 {
+			if _, ok := bindings[i].(MalSymbol); !ok {
+				c.fail(fmt.Errorf("invalid symbol(s) in variable bindings"))
+				return
+			}
+		}
+		n := len(c.locals)
+		locals := make([]*local, 0, len(bindings)/2)
+		for i := 0; i < len(bindings); i += 2 {
+			l := c.declare(bindings[i].(MalSymbol), opNewBox)
+			l.pending = true
+			locals = append(locals, l)
+		}
+		for i, l := range locals {
+			c.compile(bindings[2*i+1], false)
+			c.emitLocal(opSetLocal, l)
+			c.emit(opPop)
+			l.pending = false
+		}
+		limits := 0
+		for i, l := range locals {
+			if k := bindings[2*i].(MalSymbol); name == "let*" && isPrintLimit(k) {
+				c.emitLocal(opLocal, l)
+				c.emit(opBindLimit, c.constant(k))
+				limits++
+			}
+		}
+		if limits > 0 {
+			// the limits stay bound until the body returns, so it doesn't make tail calls
+			c.bound += limits
+			c.compile(t[2], false)
+			c.bound -= limits
+			c.emit(opUnbindLimits, limits)
+		} else if name == "let*" {
+			c.compile(t[2], tail)
+		} else {
+			outer := c.target
+			c.target = &recurTarget{start: len(c.p.code), locals: locals, bound: c.bound}
+			c.body(t[2:], tail)
+			c.target = outer
+		}
+		c.endScope(n)
+	case "recur":
+		if c.target == nil || len(t)-1 != len(c.target.locals) {
+			c.fail(fmt.Errorf("recur is only allowed in tail position of loop or fn*"))
+			return
+		}
+		for _, arg := range t[1:] {
+			c.compile(arg, false)
+		}
+		// closures made by the previous run keep their boxes
+		locals := c.target.locals
+		for _, l := range locals {
+			l.reboxAt = append(l.reboxAt, c.emit(opNop, l.slot))
+		}
+		for i := len(locals) - 1; i >= 0; i-- {
+			c.emitLocal(opSetLocal, locals[i])
+			c.emit(opPop)
+		}
+		if n := c.bound - c.target.bound; n > 0 {
+			c.emit(opUnbindLimits, n)
+		}
+		c.emit(opRecur, c.target.start)
+	case "do":
+		c.body(t[1:], tail)
+	case "if":
+		if len(t) != 3 && len(t) != 4 {
+			c.fail(fmt.Errorf("incorrect number of arguments for 'if'"))
+			return
+		}
+		c.compile(t[1], false)
+		otherwise := c.emit(opJumpIfFalse, 0)
+		c.compile(t[2], tail)
+		end := c.emit(opJump, 0)
+		c.patch(otherwise, len(c.p.code))
+		if len(t) == 4 {
+			c.compile(t[3], tail)
+		} else {
+			c.emit(opConst, c.constant(MalNil))
+		}
+		c.patch(end, len(c.p.code))
+	case "fn*":
+		if clauses, ok := arityClauses(t); ok {
+			if err := checkArities(clauses); err != nil {
+				c.fail(err)
+				return
+			}
+			first := len(c.p.protos)
+			for _, clause := range clauses {
+				params := clause.(MalList)[0].(MalVector)
+				if _, err := c.lambda(MalList(params), clause.(MalList)[1]); err != nil {
+					c.p.protos = c.p.protos[:first]
+					c.fail(err)
+					return
+				}
+			}
+			c.emit(opArities, first, len(clauses))
+			return
+		}
+		if len(t) != 3 {
+			c.fail(fmt.Errorf("incorret number of arguments for 'fn*'"))
+			return
+		}
+		params, ok := t[1].(MalList)
+		if !ok {
+			c.fail(fmt.Errorf("the first argument should be function parameter list"))
+			return
+		}
+		i, err := c.lambda(params, t[2])
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.emit(opClosure, i)
+	case "go", "future", "dosync":
+		op := map[string]opcode{"go": opGo, "future": opFuture, "dosync": opDosync}[name]
+		body := append(MalList{MalSymbol{Value: "do"}}, t[1:]...)
+		c.emit(op, c.function(nil, MalList{body}))
+	case ".":
+		if len(t) < 3 {
+			c.fail(fmt.Errorf("incorrect number of arguments for '.'"))
+			return
+		}
+		name, err := memberName(t[2])
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.compile(t[1], false)
+		for _, arg := range t[3:] {
+			c.compile(arg, false)
+		}
+		c.emit(opMethod, c.constant(MalString{Value: name}), len(t)-3)
+	case "ns", "in-ns", "require":
+		c.emit(opNamespace, c.constant(t))
+	case ".-":
+		if len(t) != 3 {
+			c.fail(fmt.Errorf("incorrect number of arguments for '.-'"))
+			return
+		}
+		name, err := memberName(t[2])
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.compile(t[1], false)
+		c.emit(opField, c.constant(MalString{Value: name}))
+	default:
+		c.fail(fmt.Errorf("unknown special form '%s'", name))
+	}
+}
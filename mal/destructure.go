@@ -0,0 +1,290 @@
+package mal
+
+import (
+	"fmt"
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+	"sort"
+	"sync/atomic"
+)
+
+// destructuring is done by rewriting the bindings of let*, loop and fn* into ones of plain
+// symbols, the values are taken apart by the builtins below which also check their shapes
+
+var gensymCounter int64
+
+// gensym returns a fresh symbol holding a value being destructured
+func gensym(prefix string) MalSymbol {
+	return MalSymbol{Value: fmt.Sprintf("%s__%d", prefix, atomic.AddInt64(&gensymCounter, 1))}
+}
+
+var (
+	keysKeyword = MalKeyword{Value: "keys"}
+	orKeyword   = MalKeyword{Value: "or"}
+	asKeyword   = MalKeyword{Value: "as"}
+	ampersand   = MalSymbol{Value: "&"}
+)
+
+// isPattern tells if a binding form destructures its value
+func isPattern(form MalType) bool {
+	switch form.(type) {
+	case MalVector, MalHashmap:
+		return true
+	default:
+		return false
+	}
+}
+
+// destructureBindings rewrites let* bindings into ones of plain symbols
+func destructureBindings(bindings MalList) (MalList, error) {
+	expanded := make(MalList, 0, len(bindings))
+	var err error
+	for i := 0; i+1 < len(bindings); i += 2 {
+		if expanded, err = destructure(bindings[i], bindings[i+1], expanded); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// destructureParams replaces the patterns of params with fresh symbols, body destructures them
+func destructureParams(params MalList, body MalType) (MalList, MalType, error) {
+	names := make(MalList, len(params))
+	var bindings MalList
+	for i, p := range params {
+		if !isPattern(p) {
+			names[i] = p
+			continue
+		}
+		names[i] = gensym("p")
+		bindings = append(bindings, p, names[i])
+	}
+	if bindings == nil {
+		return params, body, nil
+	}
+	bindings, err := destructureBindings(bindings)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, MalList{MalSymbol{Value: "let*"}, bindings, body}, nil
+}
+
+// destructureLoop rewrites a loop destructuring its bindings, so that it binds fresh symbols
+// recur sets, each run destructures them again, it returns nil if there is nothing to destructure
+func destructureLoop(t MalList, bindings MalList) (MalList, error) {
+	var outer, inner MalList
+	loop := make(MalList, 0, len(bindings))
+	for i := 0; i < len(bindings); i += 2 {
+		k := bindings[i]
+		if !isPattern(k) {
+			outer, loop = append(outer, k, bindings[i+1]), append(loop, k, k)
+			continue
+		}
+		g := gensym("loop")
+		// later bindings see the names bound by the pattern
+		outer, loop = append(outer, g, bindings[i+1], k, g), append(loop, g, g)
+		inner = append(inner, k, g)
+	}
+	if inner == nil {
+		return nil, nil
+	}
+	outer, err := destructureBindings(outer)
+	if err != nil {
+		return nil, err
+	}
+	if inner, err = destructureBindings(inner); err != nil {
+		return nil, err
+	}
+	body := append(MalList{MalSymbol{Value: "do"}}, t[2:]...)
+	return MalList{MalSymbol{Value: "let*"}, outer,
+		MalList{t[0], loop, MalList{MalSymbol{Value: "let*"}, inner, body}}}, nil
+}
+
+// destructure appends the bindings of the symbols of pattern to value to out
+func destructure(pattern, value MalType, out MalList) (MalList, error) {
+	switch p := pattern.(type) {
+	case MalSymbol:
+		if p == ampersand {
+			return nil, fmt.Errorf("invalid position for '&' in bindings")
+		}
+		return append(out, p, value), nil
+	case MalVector:
+		return destructureSeq(p, value, out)
+	case MalHashmap:
+		return destructureMap(p, value, out)
+	default:
+		return nil, fmt.Errorf("invalid binding form %s", printer.PrStr(pattern, true))
+	}
+}
+
+func destructureSeq(p MalVector, value MalType, out MalList) (MalList, error) {
+	var items MalList
+	var rest, as MalType
+	for i := 0; i < len(p); i++ {
+		switch {
+		case p[i] == ampersand && rest == nil && as == nil && i+1 < len(p):
+			i++
+			rest = p[i]
+		case p[i] == asKeyword && as == nil && i == len(p)-2:
+			i++
+			as = p[i]
+			if _, ok := as.(MalSymbol); !ok {
+				return nil, fmt.Errorf("%s is expected to be bound with :as to a symbol",
+					printer.PrStr(p, true))
+			}
+		case p[i] == ampersand || p[i] == asKeyword || rest != nil:
+			return nil, fmt.Errorf("invalid binding form %s", printer.PrStr(p, true))
+		default:
+			items = append(items, p[i])
+		}
+	}
+	s := gensym("vec")
+	out = append(out, s, MalList{seqChecker(p, len(items), rest != nil), value})
+	if as != nil {
+		out = append(out, as, s)
+	}
+	var err error
+	for i, item := range items {
+		if out, err = destructure(item, MalList{nthBuiltin, s, MalNumber{Value: i}}, out); err != nil {
+			return nil, err
+		}
+	}
+	if rest != nil {
+		return destructure(rest, MalList{dropBuiltin, s, MalNumber{Value: len(items)}}, out)
+	}
+	return out, nil
+}
+
+func destructureMap(p MalHashmap, value MalType, out MalList) (MalList, error) {
+	var defaults MalHashmap
+	if or, ok := p[orKeyword]; ok {
+		if defaults, ok = or.(MalHashmap); !ok {
+			return nil, fmt.Errorf(":or is expected to be a map of defaults in %s", printer.PrStr(p, true))
+		}
+	}
+	m := gensym("map")
+	out = append(out, m, MalList{mapChecker(p), value})
+	// bind the symbols in a stable order, defaults may refer to the ones before
+	keys := make([]MalType, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return printer.PrStr(keys[i], true) < printer.PrStr(keys[j], true)
+	})
+	lookup := func(key MalType, sym MalType) MalList {
+		get := MalList{getBuiltin, m, key}
+		if symbol, ok := sym.(MalSymbol); ok {
+			if d, ok := defaults[symbol]; ok {
+				get = append(get, d)
+			}
+		}
+		return get
+	}
+	var err error
+	for _, k := range keys {
+		switch k {
+		case orKeyword:
+		case asKeyword:
+			as, ok := p[k].(MalSymbol)
+			if !ok {
+				return nil, fmt.Errorf("%s is expected to be bound with :as to a symbol",
+					printer.PrStr(p, true))
+			}
+			out = append(out, as, m)
+		case keysKeyword:
+			names, ok := p[k].(MalVector)
+			if !ok {
+				return nil, fmt.Errorf(":keys is expected to be a vector of symbols in %s",
+					printer.PrStr(p, true))
+			}
+			for _, name := range names {
+				sym, ok := name.(MalSymbol)
+				if !ok || sym == ampersand {
+					return nil, fmt.Errorf(":keys is expected to be a vector of symbols in %s",
+						printer.PrStr(p, true))
+				}
+				out = append(out, sym, lookup(MalKeyword{Value: sym.Value}, sym))
+			}
+		default:
+			if out, err = destructure(k, lookup(p[k], k), out); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+// seqChecker returns a builtin checking a value matches the sequential pattern p of n items
+func seqChecker(p MalVector, n int, variadic bool) MalBuiltin {
+	return MalBuiltin{Name: "destructure", Fn: func(args ...MalType) (MalType, error) {
+		var items MalList
+		switch t := args[0].(type) {
+		case MalList:
+			items = t
+		case MalVector:
+			items = MalList(t)
+		default:
+			if t != MalNil {
+				return nil, fmt.Errorf("%s takes a sequence but got %s", printer.PrStr(p, true), TypeName(t))
+			}
+		}
+		if variadic && len(items) < n {
+			return nil, fmt.Errorf("%s takes at least %d elements but got %d",
+				printer.PrStr(p, true), n, len(items))
+		}
+		if !variadic && len(items) != n {
+			return nil, fmt.Errorf("%s takes %d elements but got %d", printer.PrStr(p, true), n, len(items))
+		}
+		return args[0], nil
+	}}
+}
+
+// mapChecker returns a builtin checking a value matches the map pattern p
+// sequences of keys and values are taken as maps, for keyword arguments
+func mapChecker(p MalHashmap) MalBuiltin {
+	return MalBuiltin{Name: "destructure", Fn: func(args ...MalType) (MalType, error) {
+		var kvs MalList
+		switch t := args[0].(type) {
+		case MalHashmap:
+			return t, nil
+		case MalList:
+			kvs = t
+		case MalVector:
+			kvs = MalList(t)
+		default:
+			if t != MalNil {
+				return nil, fmt.Errorf("%s takes a map but got %s", printer.PrStr(p, true), TypeName(t))
+			}
+		}
+		if len(kvs)%2 != 0 {
+			return nil, fmt.Errorf("%s takes keys and values but got %d elements",
+				printer.PrStr(p, true), len(kvs))
+		}
+		m := make(MalHashmap, len(kvs)/2)
+		for i := 0; i < len(kvs); i += 2 {
+			m[kvs[i]] = kvs[i+1]
+		}
+		return m, nil
+	}}
+}
+
+var (
+	nthBuiltin = MalBuiltin{Name: "destructure", Fn: func(args ...MalType) (MalType, error) {
+		items, _ := listOf(args[0])
+		return items[args[1].(MalNumber).Value], nil
+	}}
+	dropBuiltin = MalBuiltin{Name: "destructure", Fn: func(args ...MalType) (MalType, error) {
+		items, _ := listOf(args[0])
+		return append(MalList{}, items[args[1].(MalNumber).Value:]...), nil
+	}}
+	getBuiltin = MalBuiltin{Name: "destructure", Fn: func(args ...MalType) (MalType, error) {
+		if v, ok := args[0].(MalHashmap)[args[1]]; ok {
+			return v, nil
+		}
+		if len(args) == 3 {
+			return args[2], nil
+		}
+		return MalNil, nil
+	}}
+)
@@ -0,0 +1,148 @@
+package mal
+
+import (
+	"fmt"
+	"github.com/jiayouxujin/mal-go/env"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// SpecialForms are handled by the evaluator instead of being bound in any environment,
+// mapped to their usage
+var SpecialForms = map[string]string{
+	"def!":    "(def! sym expr)",
+	"let*":    "(let* (binding expr ...) body)",
+	"loop":    "(loop (binding expr ...) & body)",
+	"recur":   "(recur & exprs)",
+	"do":      "(do & exprs)",
+	"if":      "(if cond then else?)",
+	"fn*":     "(fn* (params ...) body) or (fn* ([params ...] body) ...)",
+	"go":      "(go & body)",
+	"future":  "(future & body)",
+	"dosync":  "(dosync & body)",
+	".":       "(. obj Method & args)",
+	".-":      "(.- obj Field)",
+	"ns":      "(ns name & (:require & specs))",
+	"in-ns":   "(in-ns name)",
+	"require": "(require & specs), a spec is lib or [lib :as alias :refer [sym ...]]",
+}
+
+// memberName returns the name of a method or field, which is a symbol or string
+func memberName(v MalType) (string, error) {
+	switch t := v.(type) {
+	case MalSymbol:
+		return t.Value, nil
+	case MalString:
+		return t.Value, nil
+	default:
+		return "", fmt.Errorf("the member name is expected to be a symbol")
+	}
+}
+
+// eval evaluates ast as a top-level form of the current namespace
+func (in *Interp) eval(ast MalType, st *evalState) (MalType, error) {
+	// the forms of a top-level do are evaluated one by one, so that ns applies to the ones after it
+	if list, ok := ast.(MalList); ok && len(list) > 0 && list[0] == (MalSymbol{Value: "do"}) {
+		var res MalType = MalNil
+		for _, form := range list[1:] {
+			var err error
+			if res, err = in.eval(form, st); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	e := in.globals(st.ns)
+	if in.optimizing {
+		ast = in.optimize(ast, e, true)
+	}
+	if err := checkRecur(ast, false, -1); err != nil {
+		return nil, err
+	}
+	if st.ns != nil {
+		ast, _ = in.qualify(ast, st.ns)
+	}
+	if in.vm {
+		return in.evalVM(ast, e, st)
+	}
+	return in.analyze(ast, nil)(e, st)
+}
+
+// apply calls f with args
+func (in *Interp) apply(f MalType, args MalList, st *evalState) (MalType, error) {
+	switch f := f.(type) {
+	case MalFunction:
+		return f(args...)
+	case MalBuiltin:
+		if f.CtxFn == nil {
+			return f.Fn(args...)
+		}
+		res, err := f.CtxFn(withState(st), args...)
+		if err != nil && st.ctx.Err() != nil {
+			return nil, contextError(st.ctx.Err())
+		}
+		return res, err
+	case MalFunctionTCO:
+		if cl, ok := f.Compiled.(*closure); ok {
+			return in.runClosure(cl, args, st)
+		}
+		l, err := in.lambdaOf(f)
+		if err != nil {
+			return nil, err
+		}
+		outer, _ := f.Env.(*env.Env)
+		return in.call(l, outer, args, st)
+	default:
+		return nil, fmt.Errorf("invalid function calling")
+	}
+}
+
+// goResult puts the value of a go block on its channel, an error is put as a Go value
+// the channel may have been closed by then, the value is dropped in that case
+func goResult(ch *MalChannel, st *evalState, v MalType, err error) {
+	if err != nil {
+		v = MalGoValue{Value: err}
+	}
+	if v != nil && v != MalNil {
+		ch.Put(st.ctx, v)
+	}
+}
+
+// lambdaOf returns the compiled body of f, which is compiled now unless f was created by fn*
+func (in *Interp) lambdaOf(f MalFunctionTCO) (*lambda, error) {
+	if l, ok := f.Compiled.(*lambda); ok {
+		return l, nil
+	}
+	// the body is compiled without knowing the slots of f.Env, so its symbols are looked up by name
+	form := MalList{MalSymbol{Value: "fn*"}, f.Params, f.AST}
+	if f.Arities != nil {
+		form = append(MalList{form[0]}, f.AST.(MalList)...)
+	}
+	v, err := in.analyzeSpecialForm("fn*", form, nil)(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return v.(MalFunctionTCO).Compiled.(*lambda), nil
+}
+
+// call evaluates the body of l with args bound in a new env
+func (in *Interp) call(l *lambda, outer *env.Env, args MalList, st *evalState) (MalType, error) {
+	l, err := l.dispatch(len(args))
+	if err != nil {
+		return nil, err
+	}
+	e, err := env.BindArgs(outer, l.names, l.variadic, args)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		v, err := l.body(e, st)
+		args, ok := v.(recurArgs)
+		if err != nil || !ok {
+			return v, err
+		}
+		// recur passes the rest arguments of a variadic function as one list
+		if e, err = env.BindArgs(outer, l.names, false, MalList(args)); err != nil {
+			return nil, err
+		}
+	}
+}
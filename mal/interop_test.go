@@ -0,0 +1,97 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+type server struct {
+	Name   string
+	Port   int
+	Config *serverConfig
+	hits   int
+}
+
+type serverConfig struct {
+	Debug bool
+}
+
+func (s *server) Addr(host string) string {
+	return fmt.Sprintf("%s:%d", host, s.Port)
+}
+
+func (s *server) Hit() int {
+	s.hits++
+	return s.hits
+}
+
+func (s *server) Self() *server {
+	return s
+}
+
+func (s *server) Fail() error {
+	return fmt.Errorf("%s is down", s.Name)
+}
+
+func (s *server) Crash() bool {
+	var config *serverConfig
+	return config.Debug
+}
+
+func (s server) Describe() string {
+	return fmt.Sprintf("%s on %d", s.Name, s.Port)
+}
+
+func TestInterop(t *testing.T) {
+	for name, opts := range backends {
+		in := New(opts...)
+		if err := in.Define("srv", MalGoValue{Value: &server{Name: "web", Port: 80, Config: &serverConfig{true}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := in.Define("copy", MalGoValue{Value: server{Name: "db", Port: 5432}}); err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			src, want string
+		}{
+			{`(. srv Addr "localhost")`, `"localhost:80"`},
+			{`(.- srv Name)`, `"web"`},
+			{`(.- (.- srv Config) Debug)`, "true"},
+			{"(. srv Hit)", "1"},
+			{"(. (. srv Self) Hit)", "2"},
+			{`(. srv "Hit")`, "3"},
+			{"srv", "#<go *mal.server>"},
+			{"(. srv Describe)", `"web on 80"`},
+			{"(. copy Describe)", `"db on 5432"`},
+		}
+		for _, test := range tests {
+			if got := evalString(t, in, test.src); got != test.want {
+				t.Errorf("%s: %s = %s, want %s", name, test.src, got, test.want)
+			}
+		}
+		errors := []struct {
+			src, want string
+		}{
+			{"(. srv Fail)", "web is down"},
+			{"(. srv Nope)", "no method Nope in *mal.server"},
+			{"(. copy Hit)", "method Hit of *mal.server has a pointer receiver, can't call it on a mal.server value"},
+			{"(. srv Crash)", "Crash: panic: runtime error: invalid memory address or nil pointer dereference"},
+			{"(.- srv hits)", "no exported field hits in mal.server"},
+			{"(. srv Addr 1)", "argument 1: expect string but get number"},
+			{"(. srv Addr)", "incorrect number of arguments: expect 1 but get 0"},
+			{"(. 5 Addr)", "can't call method Addr on number"},
+			{"(.- 5 Name)", "can't read field Name of number"},
+			{"(. srv 5)", "the member name is expected to be a symbol"},
+		}
+		for _, test := range errors {
+			_, err := in.EvalString(context.Background(), test.src)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("%s: %s fails with %v, want %s", name, test.src, err, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/core"
+	"github.com/jiayouxujin/mal-go/env"
+	"github.com/jiayouxujin/mal-go/reader"
+	. "github.com/jiayouxujin/mal-go/types"
+	"sync"
+)
+
+// Interp is a mal interpreter with its own environment, several of them can coexist in one process
+// env is the root env holding the builtins, forms are evaluated in the env of the current namespace
+type Interp struct {
+	env    *env.Env
+	limits Limits
+	vm     bool
+	// optimizing runs the optimizer on every form before it's evaluated
+	optimizing bool
+	// loadPath holds the directories require looks for libs in
+	loadPath   []string
+	mu         sync.Mutex
+	namespaces map[string]*namespace
+	// ns is the namespace evaluations start in, each one switches namespaces on its own
+	ns *namespace
+	// loaded tells the libs which are loaded, or being loaded if false
+	loaded map[string]bool
+}
+
+// Option configures an Interp
+type Option func(in *Interp)
+
+// WithLimits bounds every evaluation of the interpreter
+func WithLimits(limits Limits) Option {
+	return func(in *Interp) {
+		in.limits = limits
+	}
+}
+
+// WithVM runs the interpreter on the bytecode VM rather than the tree-walking evaluator
+func WithVM() Option {
+	return func(in *Interp) {
+		in.vm = true
+	}
+}
+
+// WithOptimizer optimizes every form before it's evaluated, see (optimize form)
+// functions optimized with a global which is redefined afterwards run as they were written
+func WithOptimizer() Option {
+	return func(in *Interp) {
+		in.optimizing = true
+	}
+}
+
+// WithLoadPath sets the directories require looks for libs in, the working directory by default
+func WithLoadPath(dirs ...string) Option {
+	return func(in *Interp) {
+		in.loadPath = dirs
+	}
+}
+
+// New creates an interpreter with the builtins and init commands in its environment
+func New(opts ...Option) *Interp {
+	in := &Interp{
+		env:        env.GetInitEnv(),
+		loadPath:   []string{"."},
+		namespaces: make(map[string]*namespace),
+		loaded:     make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(in)
+	}
+	_ = in.env.Set(MalSymbol{Value: "eval"}, MalBuiltin{Name: "eval", CtxFn: in.evalBuiltin})
+	_ = in.env.Set(MalSymbol{Value: "optimize"}, MalBuiltin{Name: "optimize", CtxFn: in.optimizeBuiltin})
+	_ = in.env.Set(MalSymbol{Value: "prn"}, MalBuiltin{Name: "prn", CtxFn: in.printBuiltin(true)})
+	_ = in.env.Set(MalSymbol{Value: "println"}, MalBuiltin{Name: "println", CtxFn: in.printBuiltin(false)})
+	for _, command := range core.InitCommands {
+		ast, err := reader.ReadStr(command)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := in.run(context.Background(), Limits{}, func(st *evalState) (MalType, error) {
+			return in.eval(ast, st)
+		}); err != nil {
+			panic(err)
+		}
+	}
+	in.setNamespace(in.namespace(DefaultNamespace, true))
+	return in
+}
+
+// Env returns the environment of the namespace evaluations start in
+func (in *Interp) Env() *env.Env {
+	return in.globals(in.currentNamespace())
+}
+
+// Define binds name to value in the root environment, which all namespaces see, Go functions
+// become builtins
+func (in *Interp) Define(name string, value MalType) error {
+	switch v := value.(type) {
+	case MalFunction:
+		value = MalBuiltin{Name: name, Fn: v}
+	case func(args ...MalType) (MalType, error):
+		value = MalBuiltin{Name: name, Fn: v}
+	case MalFunctionTCO:
+		if v.Name == "" {
+			v.Name = name
+			value = v
+		}
+	}
+	return in.env.Set(MalSymbol{Value: name}, value)
+}
+
+// DefineFunc binds name to a builtin wrapping the Go function fn, see types.WrapFunc
+func (in *Interp) DefineFunc(name string, fn interface{}) error {
+	f, err := WrapFunc(name, fn)
+	if err != nil {
+		return err
+	}
+	return in.Define(name, f)
+}
+
+// Eval evaluates ast, it aborts when ctx is done or a limit is exceeded
+// it starts in the namespace the last evaluation switching namespaces ended in, the namespaces
+// go blocks, futures and functions called by builtins switch to don't outlast them
+func (in *Interp) Eval(ctx context.Context, ast MalType) (MalType, error) {
+	return in.evalForms(ctx, MalList{ast})
+}
+
+// EvalString reads and evaluates all forms in src, returning the value of the last one
+// each form is an evaluation of its own, see Eval
+func (in *Interp) EvalString(ctx context.Context, src string) (MalType, error) {
+	forms, err := reader.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	return in.evalForms(ctx, forms)
+}
+
+// evalForms evaluates forms one by one, each in the namespace the previous one ended in
+func (in *Interp) evalForms(ctx context.Context, forms []MalType) (MalType, error) {
+	start := in.currentNamespace()
+	ns := start
+	defer func() {
+		if ns != start {
+			in.setNamespace(ns)
+		}
+	}()
+	var res MalType = MalNil
+	for _, form := range forms {
+		var err error
+		res, err = in.run(ctx, in.limits, func(st *evalState) (MalType, error) {
+			st.ns = ns
+			defer func() {
+				ns = st.ns
+			}()
+			return in.eval(form, st)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Call calls the function bound to fnName with args
+func (in *Interp) Call(fnName string, args ...MalType) (MalType, error) {
+	f, err := in.Env().Get(MalSymbol{Value: fnName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up '%s' in environments", fnName)
+	}
+	return in.run(context.Background(), in.limits, func(st *evalState) (MalType, error) {
+		return in.apply(f, args, st)
+	})
+}
+
+// run calls f with the state of a new evaluation
+func (in *Interp) run(ctx context.Context, limits Limits, f func(st *evalState) (MalType, error)) (MalType, error) {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextError(err)
+	}
+	st := newEvalState(ctx, limits)
+	st.ns = in.currentNamespace()
+	return f(st)
+}
+
+// callback calls f for a mal function called with ctx by a builtin or by Go code, it continues
+// the evaluation which called the builtin, otherwise it's a new one
+func (in *Interp) callback(ctx context.Context, f func(st *evalState) (MalType, error)) (MalType, error) {
+	if st, ok := stateFrom(ctx); ok {
+		return f(st)
+	}
+	return in.run(ctx, in.limits, f)
+}
+
+func (in *Interp) evalBuiltin(ctx context.Context, args ...MalType) (MalType, error) {
+	if err := core.AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	return in.callback(ctx, func(st *evalState) (MalType, error) {
+		return in.eval(args[0], st)
+	})
+}
@@ -0,0 +1,149 @@
+package mal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// evalString returns the printed value of src evaluated by in
+func evalString(t *testing.T, in *Interp, src string) string {
+	t.Helper()
+	v, err := in.EvalString(context.Background(), src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return printer.PrStr(v, true)
+}
+
+func TestEvalString(t *testing.T) {
+	in := New()
+	if got := evalString(t, in, "(def! sq (fn* (x) (* x x))) (sq 3) (sq 4)"); got != "16" {
+		t.Errorf("EvalString returns %s, want the value of the last form 16", got)
+	}
+	if got := evalString(t, in, ""); got != "nil" {
+		t.Errorf("EvalString of no forms returns %s, want nil", got)
+	}
+	if _, err := in.EvalString(context.Background(), "(+ 1"); err == nil {
+		t.Error("EvalString of an unbalanced form succeeds, want an error")
+	}
+}
+
+func TestDefineAndCall(t *testing.T) {
+	in := New()
+	double := func(args ...MalType) (MalType, error) {
+		return MalNumber{Value: args[0].(MalNumber).Value * 2}, nil
+	}
+	if err := in.Define("double", double); err != nil {
+		t.Fatal(err)
+	}
+	if err := in.Define("ten", MalNumber{Value: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if got := evalString(t, in, "double"); got != "#<builtin double>" {
+		t.Errorf("double = %s, want #<builtin double>", got)
+	}
+	evalString(t, in, "(def! add-ten (fn* (x) (+ x (double ten))))")
+	v, err := in.Call("add-ten", MalNumber{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != (MalNumber{Value: 21}) {
+		t.Errorf("(add-ten 1) = %v, want 21", v)
+	}
+	if _, err := in.Call("nope"); err == nil {
+		t.Error("calling an unbound function succeeds, want an error")
+	}
+}
+
+// interpreters don't see the definitions of each other
+func TestIndependentInterps(t *testing.T) {
+	a, b := New(), New()
+	evalString(t, a, "(def! x 1)")
+	evalString(t, b, "(def! x 2)")
+	if got := evalString(t, a, "x"); got != "1" {
+		t.Errorf("x = %s in the first interpreter, want 1", got)
+	}
+	if _, err := New().EvalString(context.Background(), "x"); err == nil {
+		t.Error("x is bound in a new interpreter")
+	}
+}
+
+func TestDefineFunc(t *testing.T) {
+	in := New()
+	if err := in.DefineFunc("repeat", strings.Repeat); err != nil {
+		t.Fatal(err)
+	}
+	if got := evalString(t, in, `(repeat "ab" 2)`); got != `"abab"` {
+		t.Errorf(`(repeat "ab" 2) = %s, want "abab"`, got)
+	}
+	if _, err := in.EvalString(context.Background(), "(repeat 1 2)"); err == nil {
+		t.Error("(repeat 1 2) succeeds, want a type error")
+	}
+	if err := in.DefineFunc("x", 42); err == nil {
+		t.Error("DefineFunc of a number succeeds, want an error")
+	}
+}
+
+// evaluations finishing out of order leave nothing behind for functions called later
+func TestOverlappingEvaluations(t *testing.T) {
+	for name, opts := range backends {
+		t.Run(name, func(t *testing.T) {
+			in := New(append(opts, WithLimits(Limits{Timeout: 5 * time.Second}))...)
+			evalString(t, in, "(def! c1 (chan)) (def! c2 (chan))")
+			first, second := make(chan error), make(chan error)
+			go func() {
+				_, err := in.EvalString(context.Background(), "(<! c1)")
+				first <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+			go func() {
+				_, err := in.EvalString(context.Background(), "(<! c2)")
+				second <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+			evalString(t, in, "(>! c1 1)")
+			if err := <-first; err != nil {
+				t.Fatal(err)
+			}
+			evalString(t, in, "(>! c2 2)")
+			if err := <-second; err != nil {
+				t.Fatal(err)
+			}
+			// the action runs once no evaluation is running
+			evalString(t, in, "(def! c3 (chan)) (def! a (agent 0))"+
+				" (send a (fn* (s) (do (<! c3) (count (pmap (fn* (y) y) [1 2 3])))))")
+			c3, err := in.Env().Get(MalSymbol{Value: "c3"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c3.(*MalChannel).Ch <- MalNil
+			time.Sleep(20 * time.Millisecond)
+			evalString(t, in, "(await a)")
+			if got := evalString(t, in, "(agent-error a)"); got != "nil" {
+				t.Fatalf("agent failed: %s", got)
+			}
+			if got := evalString(t, in, "(deref a)"); got != "3" {
+				t.Fatalf("(deref a) = %s, want 3", got)
+			}
+		})
+	}
+}
+
+// functions called by builtins run in the evaluation calling the builtin
+func TestCallbackLimits(t *testing.T) {
+	for name, opts := range backends {
+		t.Run(name, func(t *testing.T) {
+			in := New(append(opts, WithLimits(Limits{MaxSteps: 1000}))...)
+			_, err := in.EvalString(context.Background(),
+				"(def! a (atom 0)) (def! f (fn* (n) (if (= n 0) 0 (+ 1 (f (- n 1)))))) (swap! a (fn* (x) (f 10000)))")
+			if err != ErrStepLimit {
+				t.Fatalf("got %v, want %v", err, ErrStepLimit)
+			}
+		})
+	}
+}
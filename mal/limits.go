@@ -0,0 +1,125 @@
+package mal
+
+import (
+	"context"
+	"errors"
+	. "github.com/jiayouxujin/mal-go/types"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxDepth keeps evaluations well below the Go stack limit, which can't be recovered from
+const DefaultMaxDepth = 100000
+
+// checkInterval is the number of evaluation steps between two checks of the context
+const checkInterval = 256
+
+var (
+	// ErrInterrupted is returned when the evaluation is canceled, e.g. by Ctrl-C
+	ErrInterrupted = errors.New("interrupted")
+	// ErrTimeout is returned when the evaluation runs out of wall time
+	ErrTimeout = errors.New("evaluation timed out")
+	// ErrStepLimit is returned when the evaluation takes too many steps
+	ErrStepLimit = errors.New("evaluation step limit exceeded")
+	// ErrDepthLimit is returned when the evaluation nests too deeply
+	ErrDepthLimit = errors.New("evaluation depth limit exceeded")
+)
+
+// Limits bounds an evaluation, a zero field means no limit except for MaxDepth
+type Limits struct {
+	// MaxSteps is the max number of forms evaluated
+	MaxSteps int64
+	// MaxDepth is the max nesting of forms being evaluated, DefaultMaxDepth if it's zero and
+	// no limit if it's negative
+	MaxDepth int
+	// Timeout is the max wall time of the evaluation
+	Timeout time.Duration
+}
+
+// budget is shared by an evaluation and the goroutines it spawns
+type budget struct {
+	limits Limits
+	steps  int64
+}
+
+// evalState tracks the budget consumed by a running evaluation on one goroutine
+// ctx may carry values bound to the goroutine, e.g. the running transaction
+type evalState struct {
+	*budget
+	ctx   context.Context
+	depth int
+	// ns is the namespace forms are evaluated in, switched by ns and in-ns
+	ns *namespace
+	// printLimits are the print limits bound by the let* being evaluated, innermost first
+	printLimits *printLimit
+}
+
+func newEvalState(ctx context.Context, limits Limits) *evalState {
+	if limits.MaxDepth == 0 {
+		limits.MaxDepth = DefaultMaxDepth
+	}
+	return &evalState{budget: &budget{limits: limits}, ctx: ctx}
+}
+
+// fork returns the state of another goroutine sharing the budget of st
+// transactions are bound to a goroutine so the running one isn't shared
+func (st *evalState) fork() *evalState {
+	return &evalState{budget: st.budget, ctx: WithTxn(st.ctx, nil), ns: st.ns, printLimits: st.printLimits}
+}
+
+// withContext returns the state of the same goroutine with another context
+func (st *evalState) withContext(ctx context.Context) *evalState {
+	return &evalState{budget: st.budget, ctx: ctx, depth: st.depth, ns: st.ns, printLimits: st.printLimits}
+}
+
+// stateKey is the context key of the state of the evaluation calling a builtin
+type stateKey struct{}
+
+// withState returns the context a builtin is called with, mal functions it calls continue st
+// the depth st has now is carried, not st itself which its goroutine goes on changing
+func withState(st *evalState) context.Context {
+	return context.WithValue(st.ctx, stateKey{}, st.withContext(nil))
+}
+
+// stateFrom returns the state of the evaluation which called a builtin with ctx, ctx being the
+// one the builtin passes on, e.g. with its cancellation
+func stateFrom(ctx context.Context) (*evalState, bool) {
+	caller, ok := ctx.Value(stateKey{}).(*evalState)
+	if !ok {
+		return nil, false
+	}
+	return caller.withContext(ctx), true
+}
+
+// enter accounts for one more form being evaluated
+func (st *evalState) enter() error {
+	steps := atomic.AddInt64(&st.steps, 1)
+	if st.limits.MaxSteps > 0 && steps > st.limits.MaxSteps {
+		return ErrStepLimit
+	}
+	if st.limits.MaxDepth > 0 && st.depth >= st.limits.MaxDepth {
+		return ErrDepthLimit
+	}
+	if steps%checkInterval == 0 {
+		select {
+		case <-st.ctx.Done():
+			return contextError(st.ctx.Err())
+		default:
+		}
+	}
+	st.depth++
+	return nil
+}
+
+// leave accounts for a form finishing its evaluation
+func (st *evalState) leave() {
+	st.depth--
+}
+
+// contextError converts the error of a done context to ErrTimeout or ErrInterrupted
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrInterrupted
+}
@@ -0,0 +1,41 @@
+package mal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	const defs = `(def! forever (fn* () (forever)))
+		(def! deep (fn* (n) (if (= n 0) 0 (+ 1 (deep (- n 1))))))`
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		ctx    context.Context
+		src    string
+		limits Limits
+		want   error
+	}{
+		{context.Background(), "(forever)", Limits{MaxSteps: 10000}, ErrStepLimit},
+		{context.Background(), "(deep 1000)", Limits{MaxDepth: 100}, ErrDepthLimit},
+		{context.Background(), "(forever)", Limits{Timeout: 50 * time.Millisecond}, ErrTimeout},
+		{canceled, "(+ 1 2)", Limits{}, ErrInterrupted},
+		{context.Background(), "(deep 1000)", Limits{MaxSteps: 1000000, MaxDepth: 100000}, nil},
+		// DefaultMaxDepth stops a runaway recursion before it overflows the Go stack
+		{context.Background(), "(deep 50000000)", Limits{Timeout: time.Minute}, ErrDepthLimit},
+		// a negative MaxDepth disables the limit
+		{context.Background(), "(deep 50000)", Limits{MaxDepth: -1}, nil},
+	}
+	for name, opts := range backends {
+		for _, test := range tests {
+			in := New(append(opts, WithLimits(test.limits))...)
+			if _, err := in.EvalString(context.Background(), defs); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := in.EvalString(test.ctx, test.src); err != test.want {
+				t.Errorf("%s: %s with %+v fails with %v, want %v", name, test.src, test.limits, err, test.want)
+			}
+		}
+	}
+}
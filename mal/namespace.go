@@ -0,0 +1,373 @@
+package mal
+
+import (
+	"fmt"
+	"github.com/jiayouxujin/mal-go/env"
+	"github.com/jiayouxujin/mal-go/printer"
+	"github.com/jiayouxujin/mal-go/reader"
+	. "github.com/jiayouxujin/mal-go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the namespace forms are evaluated in until ns or in-ns switch to another
+const DefaultNamespace = "user"
+
+// namespace is a global env, every namespace sees the builtins bound in the root env
+type namespace struct {
+	name    string
+	env     *env.Env
+	aliases map[string]*namespace // set by require with :as
+}
+
+// qualified is a symbol naming a global of a namespace, foo/bar, resolved before evaluation
+type qualified struct {
+	sym MalSymbol
+	env *env.Env
+	id  int
+}
+
+func (q qualified) get() (MalType, error) {
+	if v, err := q.env.GetID(q.id); err == nil {
+		return v, nil
+	}
+	return nil, fmt.Errorf("failed to look up '%s' in environments", q.sym.Value)
+}
+
+// globals returns the env of ns, it's the root env until there is a namespace
+func (in *Interp) globals(ns *namespace) *env.Env {
+	if ns == nil {
+		return in.env
+	}
+	return ns.env
+}
+
+// Namespace returns the name of the namespace evaluations start in, see Eval
+func (in *Interp) Namespace() string {
+	return in.currentNamespace().name
+}
+
+// currentNamespace returns the namespace evaluations start in
+func (in *Interp) currentNamespace() *namespace {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.ns
+}
+
+func (in *Interp) setNamespace(ns *namespace) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.ns = ns
+}
+
+// namespace returns the namespace called name, creating it if create is set
+func (in *Interp) namespace(name string, create bool) *namespace {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	ns, ok := in.namespaces[name]
+	if !ok && create {
+		e, _ := env.CreateEnv(in.env, nil, nil)
+		ns = &namespace{name: name, env: e, aliases: make(map[string]*namespace)}
+		in.namespaces[name] = ns
+	}
+	return ns
+}
+
+// qualify resolves the qualified symbols of ast by the aliases of ns, then by the names of
+// namespaces, the others are left as they are
+// it reports whether any symbol was resolved, ast is only copied then
+func (in *Interp) qualify(ast MalType, ns *namespace) (MalType, bool) {
+	switch t := ast.(type) {
+	case MalSymbol:
+		i := strings.IndexByte(t.Value, '/')
+		if i <= 0 || i == len(t.Value)-1 {
+			return t, false
+		}
+		prefix, name := t.Value[:i], t.Value[i+1:]
+		in.mu.Lock()
+		target, ok := ns.aliases[prefix]
+		if !ok {
+			target, ok = in.namespaces[prefix]
+		}
+		in.mu.Unlock()
+		if !ok {
+			return t, false
+		}
+		return qualified{sym: t, env: target.env, id: Intern(name)}, true
+	case MalList:
+		list, changed := in.qualifyAll(t, ns)
+		return list, changed
+	case MalVector:
+		list, changed := in.qualifyAll(MalList(t), ns)
+		return MalVector(list), changed
+	case MalHashmap:
+		result := make(MalHashmap, len(t))
+		changed := false
+		for k, v := range t {
+			var c bool
+			result[k], c = in.qualify(v, ns)
+			changed = changed || c
+		}
+		if !changed {
+			return t, false
+		}
+		return result, true
+	default:
+		return ast, false
+	}
+}
+
+func (in *Interp) qualifyAll(list MalList, ns *namespace) (MalList, bool) {
+	var result MalList
+	for i, v := range list {
+		q, changed := in.qualify(v, ns)
+		if changed && result == nil {
+			result = append(MalList(nil), list...)
+		}
+		if result != nil {
+			result[i] = q
+		}
+	}
+	if result == nil {
+		return list, false
+	}
+	return result, true
+}
+
+// namespaceForm evaluates ns, in-ns and require
+func (in *Interp) namespaceForm(t MalList, st *evalState) (MalType, error) {
+	switch t[0].(MalSymbol).Value {
+	case "in-ns":
+		if len(t) != 2 {
+			return nil, fmt.Errorf("incorrect number of arguments for 'in-ns'")
+		}
+		name, ok := t[1].(MalSymbol)
+		if !ok {
+			return nil, fmt.Errorf("the name of a namespace is expected to be a symbol")
+		}
+		st.ns = in.namespace(name.Value, true)
+		return MalNil, nil
+	case "ns":
+		if len(t) < 2 {
+			return nil, fmt.Errorf("incorrect number of arguments for 'ns'")
+		}
+		name, ok := t[1].(MalSymbol)
+		if !ok {
+			return nil, fmt.Errorf("the name of a namespace is expected to be a symbol")
+		}
+		st.ns = in.namespace(name.Value, true)
+		for _, clause := range t[2:] {
+			c, ok := clause.(MalList)
+			if !ok || len(c) == 0 || c[0] != (MalKeyword{Value: "require"}) {
+				return nil, fmt.Errorf("invalid clause %s of 'ns', expected (:require & specs)",
+					printer.PrStr(clause, true))
+			}
+			if err := in.require(c[1:], st); err != nil {
+				return nil, err
+			}
+		}
+		return MalNil, nil
+	default:
+		return MalNil, in.require(t[1:], st)
+	}
+}
+
+// libSpec is what a lib is required with, lib or [lib :as alias :refer [syms ...]]
+type libSpec struct {
+	lib   string
+	as    string
+	refer []MalSymbol
+}
+
+func parseLibSpec(spec MalType) (libSpec, error) {
+	if lib, ok := spec.(MalSymbol); ok {
+		return libSpec{lib: lib.Value}, nil
+	}
+	v, ok := spec.(MalVector)
+	if !ok || len(v) == 0 || len(v)%2 != 1 {
+		return libSpec{}, fmt.Errorf("invalid lib spec %s, expected lib or [lib & options]",
+			printer.PrStr(spec, true))
+	}
+	lib, ok := v[0].(MalSymbol)
+	if !ok {
+		return libSpec{}, fmt.Errorf("the name of a lib is expected to be a symbol")
+	}
+	s := libSpec{lib: lib.Value}
+	for i := 1; i < len(v); i += 2 {
+		switch v[i] {
+		case MalKeyword{Value: "as"}:
+			alias, ok := v[i+1].(MalSymbol)
+			if !ok {
+				return libSpec{}, fmt.Errorf(":as is expected to be followed by a symbol")
+			}
+			s.as = alias.Value
+		case MalKeyword{Value: "refer"}:
+			names, ok := v[i+1].(MalVector)
+			if !ok {
+				return libSpec{}, fmt.Errorf(":refer is expected to be followed by a vector of symbols")
+			}
+			for _, name := range names {
+				sym, ok := name.(MalSymbol)
+				if !ok {
+					return libSpec{}, fmt.Errorf(":refer is expected to be followed by a vector of symbols")
+				}
+				s.refer = append(s.refer, sym)
+			}
+		default:
+			return libSpec{}, fmt.Errorf("invalid option %s of lib %s", printer.PrStr(v[i], true), s.lib)
+		}
+	}
+	return s, nil
+}
+
+// require loads the libs of specs, then aliases them and refers their symbols in the current namespace
+func (in *Interp) require(specs MalList, st *evalState) error {
+	for _, spec := range specs {
+		s, err := parseLibSpec(spec)
+		if err != nil {
+			return err
+		}
+		lib, err := in.load(s.lib, st)
+		if err != nil {
+			return err
+		}
+		current := st.ns
+		if s.as != "" {
+			in.mu.Lock()
+			current.aliases[s.as] = lib
+			in.mu.Unlock()
+		}
+		// referred symbols are bound to the values they have now
+		for _, sym := range s.refer {
+			v, err := lib.env.Get(sym)
+			if err != nil {
+				return fmt.Errorf("'%s' is not defined in namespace %s", sym.Value, lib.name)
+			}
+			if err := current.env.Set(sym, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load loads the file of lib from the load path unless it's loaded already, and returns its namespace
+// a lib is loaded once by each interpreter, even if it's required again, see readLib
+func (in *Interp) load(lib string, st *evalState) (*namespace, error) {
+	in.mu.Lock()
+	done, seen := in.loaded[lib]
+	if !seen {
+		in.loaded[lib] = false
+	}
+	in.mu.Unlock()
+	if seen && !done {
+		return nil, fmt.Errorf("lib %s is required while it's loading", lib)
+	}
+	if !seen {
+		file, ok := in.findLib(lib)
+		if !ok {
+			in.mu.Lock()
+			delete(in.loaded, lib)
+			in.mu.Unlock()
+			// namespaces made by ns at the REPL need no file
+			if ns := in.namespace(lib, false); ns != nil {
+				return ns, nil
+			}
+			return nil, fmt.Errorf("could not find lib %s in the load path %s",
+				lib, strings.Join(in.loadPath, string(os.PathListSeparator)))
+		}
+		err := in.loadFile(file, st)
+		in.mu.Lock()
+		if err != nil {
+			delete(in.loaded, lib)
+		} else {
+			in.loaded[lib] = true
+		}
+		in.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	ns := in.namespace(lib, false)
+	if ns == nil {
+		return nil, fmt.Errorf("lib %s doesn't define namespace %s", lib, lib)
+	}
+	return ns, nil
+}
+
+// findLib returns the file of lib in the load path, lib foo.bar is in foo/bar.mal
+func (in *Interp) findLib(lib string) (string, bool) {
+	name := filepath.FromSlash(strings.ReplaceAll(lib, ".", "/")) + ".mal"
+	for _, dir := range in.loadPath {
+		file := filepath.Join(dir, name)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// libForms caches the forms read from the files of libs for all interpreters of the process,
+// each interpreter still evaluates a lib once in its own namespaces
+var libForms = struct {
+	sync.Mutex
+	files map[string]libFile
+}{files: make(map[string]libFile)}
+
+// libFile is the forms of a file as it was when it was read
+type libFile struct {
+	modTime time.Time
+	size    int64
+	forms   []MalType
+}
+
+// readLib returns the forms of file, it's only read again once it's changed
+func readLib(file string) ([]MalType, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	libForms.Lock()
+	cached, ok := libForms.files[path]
+	libForms.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.forms, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	forms, err := reader.ReadAll(string(content))
+	if err != nil {
+		return nil, err
+	}
+	libForms.Lock()
+	libForms.files[path] = libFile{modTime: info.ModTime(), size: info.Size(), forms: forms}
+	libForms.Unlock()
+	return forms, nil
+}
+
+// loadFile evaluates the forms of file one by one, the namespace of st is restored afterwards
+func (in *Interp) loadFile(file string, st *evalState) error {
+	forms, err := readLib(file)
+	if err != nil {
+		return err
+	}
+	defer func(ns *namespace) {
+		st.ns = ns
+	}(st.ns)
+	for _, form := range forms {
+		if _, err := in.eval(form, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
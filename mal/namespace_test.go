@@ -0,0 +1,72 @@
+package mal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// each evaluation switches namespaces on its own, the next one starts where the last one ended
+func TestNamespacePerEvaluation(t *testing.T) {
+	for name, opts := range backends {
+		t.Run(name, func(t *testing.T) {
+			in := New(opts...)
+			evalString(t, in, "(def! c (chan))")
+			done := make(chan error)
+			go func() {
+				_, err := in.EvalString(context.Background(), "(in-ns a) (user/<! user/c) (def! v 1)")
+				done <- err
+			}()
+			time.Sleep(20 * time.Millisecond)
+			evalString(t, in, "(def! w 2)")
+			if got := in.Namespace(); got != DefaultNamespace {
+				t.Errorf("the namespace is %s while the other evaluation runs, want %s", got, DefaultNamespace)
+			}
+			evalString(t, in, "(>! c 1)")
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if got := in.Namespace(); got != "a" {
+				t.Errorf("the namespace is %s, want a", got)
+			}
+			if got := evalString(t, in, "[v user/w]"); got != "[1 2]" {
+				t.Errorf("[v user/w] = %s, want [1 2]", got)
+			}
+		})
+	}
+}
+
+// the files of libs are read once by the process, all interpreters evaluate the forms read
+func TestLibFormsCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cached.mal")
+	write := func(src string, modTime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	required := func() string {
+		in := New(WithLoadPath(dir))
+		return evalString(t, in, "(require cached) cached/v")
+	}
+	modTime := time.Now().Add(-time.Hour)
+	write("(ns cached) (def! v 1)", modTime)
+	if got := required(); got != "1" {
+		t.Fatalf("cached/v = %s, want 1", got)
+	}
+	// the same size and time, so the forms read before are evaluated
+	write("(ns cached) (def! v 2)", modTime)
+	if got := required(); got != "1" {
+		t.Errorf("cached/v = %s from the unchanged file, want 1", got)
+	}
+	write("(ns cached) (def! v 30)", modTime)
+	if got := required(); got != "30" {
+		t.Errorf("cached/v = %s from the changed file, want 30", got)
+	}
+}
@@ -0,0 +1,573 @@
+package mal
+
+import (
+	"context"
+	"github.com/jiayouxujin/mal-go/core"
+	"github.com/jiayouxujin/mal-go/env"
+	. "github.com/jiayouxujin/mal-go/types"
+	"reflect"
+	"sync/atomic"
+)
+
+// pureBuiltins are the builtins the optimizer calls ahead of evaluation when their arguments are literals
+var pureBuiltins = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true,
+	"=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"list?": true, "empty?": true, "count": true,
+}
+
+const (
+	// maxInlineSize is the max number of forms in the body of an inlined function
+	maxInlineSize = 16
+	// maxInlineDepth bounds functions inlined in the bodies of inlined functions
+	maxInlineDepth = 4
+)
+
+// optimizer rewrites a form before it's evaluated: it folds pure builtin calls on literals,
+// drops the dead branches of `if` and inlines small functions
+// only globals which were never redefined are trusted
+// the bodies of functions depending on globals are guarded so that once one of them is
+// redefined, the functions run their bodies as they were written
+type optimizer struct {
+	in *Interp
+	// env is the env of the namespace the form is evaluated in
+	env *env.Env
+	// guarding guards the optimized bodies of functions, the form isn't evaluated otherwise
+	guarding bool
+	// deps holds the globals folded or inlined in the body of the innermost fn*
+	deps []dependency
+	// locals counts the symbols bound by the enclosing let* and fn*
+	locals map[string]int
+	// defined holds the symbols set by def! in the form, which may shadow globals
+	defined map[string]bool
+	// inlining holds the names of the functions being inlined
+	inlining []string
+}
+
+// dependency is a global optimized code was made with and its value then
+type dependency struct {
+	sym   MalSymbol
+	value MalType
+}
+
+// optimize returns ast optimized, it's evaluated in the global environment
+// the functions it defines are guarded if guarding is set, see optimizer
+func (in *Interp) optimize(ast MalType, e *env.Env, guarding bool) MalType {
+	o := &optimizer{in: in, env: e, guarding: guarding, locals: make(map[string]int), defined: make(map[string]bool)}
+	walk(ast, func(t MalList) {
+		if len(t) == 3 && t[0] == (MalSymbol{Value: "def!"}) {
+			if k, ok := t[1].(MalSymbol); ok {
+				o.defined[k.Value] = true
+			}
+		}
+	})
+	return o.optimize(ast)
+}
+
+func (in *Interp) optimizeBuiltin(ctx context.Context, args ...MalType) (MalType, error) {
+	if err := core.AssertLength(args, 1); err != nil {
+		return nil, err
+	}
+	ns := in.currentNamespace()
+	if st, ok := stateFrom(ctx); ok {
+		ns = st.ns
+	}
+	return in.optimize(args[0], in.globals(ns), false), nil
+}
+
+// walk calls f with all lists in ast
+func walk(ast MalType, f func(MalList)) {
+	switch t := ast.(type) {
+	case MalList:
+		f(t)
+		for _, v := range t {
+			walk(v, f)
+		}
+	case MalVector:
+		for _, v := range t {
+			walk(v, f)
+		}
+	case MalHashmap:
+		for _, v := range t {
+			walk(v, f)
+		}
+	}
+}
+
+// destructures tells if a let*, loop or fn* in ast binds a pattern
+func destructures(ast MalType) bool {
+	found := false
+	walk(ast, func(list MalList) {
+		if len(list) < 2 {
+			return
+		}
+		switch list[0] {
+		case MalSymbol{Value: "let*"}, MalSymbol{Value: "loop"}:
+			bindings, _ := listOf(list[1])
+			for i := 0; i < len(bindings); i += 2 {
+				found = found || isPattern(bindings[i])
+			}
+		case MalSymbol{Value: "fn*"}:
+			params, _ := list[1].(MalList)
+			for _, p := range params {
+				found = found || isPattern(p)
+			}
+		}
+	})
+	return found
+}
+
+// symbolsOf returns the names of all symbols in ast
+func symbolsOf(ast MalType) map[string]bool {
+	names := make(map[string]bool)
+	var collect func(MalType)
+	collect = func(ast MalType) {
+		switch t := ast.(type) {
+		case MalSymbol:
+			names[t.Value] = true
+		case MalList:
+			for _, v := range t {
+				collect(v)
+			}
+		case MalVector:
+			for _, v := range t {
+				collect(v)
+			}
+		case MalHashmap:
+			for _, v := range t {
+				collect(v)
+			}
+		}
+	}
+	collect(ast)
+	return names
+}
+
+// size returns the number of forms in ast
+func size(ast MalType) int {
+	n := 1
+	switch t := ast.(type) {
+	case MalList:
+		for _, v := range t {
+			n += size(v)
+		}
+	case MalVector:
+		for _, v := range t {
+			n += size(v)
+		}
+	case MalHashmap:
+		for _, v := range t {
+			n += size(v)
+		}
+	}
+	return n
+}
+
+// isLiteral reports whether ast evaluates to itself
+func isLiteral(ast MalType) bool {
+	switch t := ast.(type) {
+	case MalNumber, MalString, MalKeyword, MalLiteral:
+		return true
+	case MalList:
+		return len(t) == 0
+	default:
+		return false
+	}
+}
+
+func (o *optimizer) bind(names ...MalSymbol) {
+	for _, name := range names {
+		o.locals[name.Value]++
+	}
+}
+
+func (o *optimizer) unbind(names ...MalSymbol) {
+	for _, name := range names {
+		o.locals[name.Value]--
+	}
+}
+
+// known returns the value of a global which can be trusted
+func (o *optimizer) known(sym MalSymbol) (MalType, bool) {
+	if o.locals[sym.Value] > 0 || o.defined[sym.Value] || o.env.Redefined(sym) || o.in.env.Redefined(sym) {
+		return nil, false
+	}
+	// a namespace binding a builtin's name redefines it as well
+	if e, _ := o.env.Find(sym).(*env.Env); e != o.in.env && o.in.env.Find(sym) != nil {
+		return nil, false
+	}
+	v, err := o.env.Get(sym)
+	return v, err == nil
+}
+
+// depend records that the optimized code relies on v being the value of the global sym
+func (o *optimizer) depend(sym MalSymbol, v MalType) {
+	o.deps = append(o.deps, dependency{sym: sym, value: v})
+}
+
+// same reports whether v and w are the same function
+func same(v, w MalType) bool {
+	switch v := v.(type) {
+	case MalBuiltin:
+		b, ok := w.(MalBuiltin)
+		return ok && b.Name == v.Name && reflect.ValueOf(b.Fn).Pointer() == reflect.ValueOf(v.Fn).Pointer()
+	case MalFunctionTCO:
+		f, ok := w.(MalFunctionTCO)
+		return ok && f.Compiled == v.Compiled && f.Env == v.Env
+	default:
+		return false
+	}
+}
+
+// guard returns a builtin telling whether the globals of deps still have their values
+// it only looks them up again when a global was set since the last call
+func (o *optimizer) guard(deps []dependency) MalBuiltin {
+	e := o.env
+	checked, stale := e.Version(), int32(0)
+	return MalBuiltin{Name: "optimized?", Fn: func(args ...MalType) (MalType, error) {
+		version := e.Version()
+		if atomic.LoadInt32(&stale) == 1 {
+			return MalFalse, nil
+		}
+		if atomic.LoadUint64(&checked) == version {
+			return MalTrue, nil
+		}
+		for _, dep := range deps {
+			if v, err := e.Get(dep.sym); err != nil || !same(dep.value, v) {
+				atomic.StoreInt32(&stale, 1)
+				return MalFalse, nil
+			}
+		}
+		atomic.StoreUint64(&checked, version)
+		return MalTrue, nil
+	}}
+}
+
+func (o *optimizer) optimizeAll(list MalList) MalList {
+	result := make(MalList, len(list))
+	for i, v := range list {
+		result[i] = o.optimize(v)
+	}
+	return result
+}
+
+func (o *optimizer) optimize(ast MalType) MalType {
+	switch t := ast.(type) {
+	case MalList:
+		if len(t) == 0 {
+			return t
+		}
+		if symbol, ok := t[0].(MalSymbol); ok {
+			if _, ok := SpecialForms[symbol.Value]; ok {
+				return o.specialForm(symbol.Value, t)
+			}
+		}
+		t = o.optimizeAll(t)
+		if symbol, ok := t[0].(MalSymbol); ok {
+			if v, ok := o.fold(symbol, t[1:]); ok {
+				return v
+			}
+			if v, ok := o.inline(symbol, t[1:]); ok {
+				return v
+			}
+		}
+		return t
+	case MalVector:
+		return MalVector(o.optimizeAll(MalList(t)))
+	case MalHashmap:
+		result := make(MalHashmap, len(t))
+		for k, v := range t {
+			result[k] = o.optimize(v)
+		}
+		return result
+	default:
+		return ast
+	}
+}
+
+func (o *optimizer) specialForm(name string, t MalList) MalType {
+	switch name {
+	case "def!":
+		if len(t) != 3 {
+			return t
+		}
+		return MalList{t[0], t[1], o.optimize(t[2])}
+	case "let*", "loop":
+		if name == "let*" && len(t) != 3 || len(t) < 2 {
+			return t
+		}
+		bindings, ok := t[1].(MalList)
+		if name == "loop" {
+			bindings, ok = listOf(t[1])
+		}
+		if !ok || len(bindings)%2 != 0 {
+			return t
+		}
+		names := make([]MalSymbol, 0, len(bindings)/2)
+		for i := 0; i < len(bindings); i += 2 {
+			k, ok := bindings[i].(MalSymbol)
+			if !ok {
+				return t
+			}
+			names = append(names, k)
+		}
+		optimized := make(MalList, len(bindings))
+		for i, k := range names {
+			optimized[2*i], optimized[2*i+1] = k, o.optimize(bindings[2*i+1])
+			o.bind(k)
+		}
+		body := o.optimizeAll(t[2:])
+		o.unbind(names...)
+		return append(MalList{t[0], optimized}, body...)
+	case "fn*":
+		if len(t) != 3 {
+			return t
+		}
+		params, ok := t[1].(MalList)
+		if !ok {
+			return t
+		}
+		names := make([]MalSymbol, len(params))
+		for i, p := range params {
+			if names[i], ok = p.(MalSymbol); !ok {
+				return t
+			}
+		}
+		o.bind(names...)
+		deps := o.deps
+		o.deps = nil
+		body := o.optimize(t[2])
+		if o.guarding && len(o.deps) > 0 {
+			body = MalList{MalSymbol{Value: "if"}, MalList{o.guard(o.deps)}, body, t[2]}
+		}
+		o.deps = deps
+		o.unbind(names...)
+		return MalList{t[0], params, body}
+	case "if":
+		if len(t) != 3 && len(t) != 4 {
+			return t
+		}
+		condition := o.optimize(t[1])
+		if isLiteral(condition) {
+			if condition != MalFalse && condition != MalNil {
+				return o.optimize(t[2])
+			} else if len(t) == 4 {
+				return o.optimize(t[3])
+			}
+			return MalNil
+		}
+		return append(MalList{t[0], condition}, o.optimizeAll(t[2:])...)
+	case ".", ".-":
+		if len(t) < 3 {
+			return t
+		}
+		return append(MalList{t[0], o.optimize(t[1]), t[2]}, o.optimizeAll(t[3:])...)
+	case "ns", "in-ns", "require":
+		return t
+	default:
+		return append(MalList{t[0]}, o.optimizeAll(t[1:])...)
+	}
+}
+
+// fold calls a pure builtin on literal arguments
+func (o *optimizer) fold(sym MalSymbol, args MalList) (MalType, bool) {
+	v, ok := o.known(sym)
+	if !ok {
+		return nil, false
+	}
+	b, ok := v.(MalBuiltin)
+	if !ok || !pureBuiltins[b.Name] {
+		return nil, false
+	}
+	for _, arg := range args {
+		if !isLiteral(arg) {
+			return nil, false
+		}
+	}
+	res, err := Call(b, args...)
+	if err != nil || !isLiteral(res) { // errors are left to be reported by the evaluation
+		return nil, false
+	}
+	o.depend(sym, b)
+	return res, true
+}
+
+// inline replaces a call to a small global function by its body
+// literal and symbol arguments are substituted for the parameters, the others are bound by let*
+func (o *optimizer) inline(sym MalSymbol, args MalList) (MalType, bool) {
+	if len(o.inlining) >= maxInlineDepth {
+		return nil, false
+	}
+	for _, name := range o.inlining {
+		if name == sym.Value {
+			return nil, false
+		}
+	}
+	v, ok := o.known(sym)
+	if !ok {
+		return nil, false
+	}
+	f, ok := v.(MalFunctionTCO)
+	if !ok || f.Arities != nil || len(f.Params) != len(args) || size(f.AST) > maxInlineSize {
+		return nil, false
+	}
+	// the body must not depend on the env of the function
+	if e, ok := f.Env.(*env.Env); !ok || e != o.env {
+		return nil, false
+	}
+	if cl, ok := f.Compiled.(*closure); ok && len(cl.proto.upvalues) > 0 {
+		return nil, false
+	}
+	params := make(map[string]bool, len(f.Params))
+	for _, p := range f.Params {
+		param, ok := p.(MalSymbol)
+		if !ok || param.Value == "&" {
+			return nil, false
+		}
+		params[param.Value] = true
+	}
+	body := symbolsOf(f.AST)
+	// recursive, setting its own env or recurring to itself
+	if body[sym.Value] || body["def!"] || body["recur"] {
+		return nil, false
+	}
+	if destructures(f.AST) { // the bindings of patterns aren't substituted
+		return nil, false
+	}
+	for name := range body {
+		if !params[name] && o.locals[name] > 0 { // shadowed where it's called
+			return nil, false
+		}
+	}
+	substitute := true
+	for i, arg := range args {
+		a, ok := arg.(MalSymbol)
+		switch {
+		case isLiteral(arg):
+		case ok && (!body[a.Value] || a == f.Params[i]):
+		default:
+			substitute = false
+		}
+	}
+	var inlined MalType
+	if substitute {
+		replacements := make(map[string]MalType, len(args))
+		for i, p := range f.Params {
+			replacements[p.(MalSymbol).Value] = args[i]
+		}
+		inlined = substituteSymbols(f.AST, replacements)
+	} else {
+		for name := range symbolsOf(args) {
+			if params[name] { // would be captured by the bindings of the previous parameters
+				return nil, false
+			}
+		}
+		bindings := make(MalList, 0, 2*len(args))
+		for i, p := range f.Params {
+			bindings = append(bindings, p, args[i])
+		}
+		inlined = MalList{MalSymbol{Value: "let*"}, bindings, f.AST}
+	}
+	o.depend(sym, f)
+	o.inlining = append(o.inlining, sym.Value)
+	defer func() {
+		o.inlining = o.inlining[:len(o.inlining)-1]
+	}()
+	return o.optimize(inlined), true
+}
+
+// substituteSymbols replaces the symbols of ast which aren't bound inside it
+func substituteSymbols(ast MalType, replacements map[string]MalType) MalType {
+	if len(replacements) == 0 {
+		return ast
+	}
+	switch t := ast.(type) {
+	case MalSymbol:
+		if v, ok := replacements[t.Value]; ok {
+			return v
+		}
+		return t
+	case MalList:
+		if len(t) == 0 {
+			return t
+		}
+		head, _ := t[0].(MalSymbol)
+		switch head.Value {
+		case "let*", "loop":
+			if head.Value == "let*" && len(t) != 3 || len(t) < 2 {
+				break
+			}
+			bindings, ok := t[1].(MalList)
+			if head.Value == "loop" {
+				bindings, ok = listOf(t[1])
+			}
+			if !ok {
+				break
+			}
+			inner := shadow(replacements, nil)
+			result := make(MalList, len(bindings))
+			for i := 0; i+1 < len(bindings); i += 2 {
+				result[i], result[i+1] = bindings[i], substituteSymbols(bindings[i+1], inner)
+				if k, ok := bindings[i].(MalSymbol); ok {
+					inner = shadow(inner, MalList{k})
+				}
+			}
+			body := make(MalList, len(t)-2)
+			for i, v := range t[2:] {
+				body[i] = substituteSymbols(v, inner)
+			}
+			return append(MalList{t[0], result}, body...)
+		case "fn*":
+			if len(t) != 3 {
+				break
+			}
+			params, ok := t[1].(MalList)
+			if !ok {
+				break
+			}
+			return MalList{t[0], params, substituteSymbols(t[2], shadow(replacements, params))}
+		case ".", ".-":
+			if len(t) < 3 {
+				break
+			}
+			result := append(MalList{t[0], substituteSymbols(t[1], replacements), t[2]}, t[3:]...)
+			for i := 3; i < len(result); i++ {
+				result[i] = substituteSymbols(result[i], replacements)
+			}
+			return result
+		}
+		result := make(MalList, len(t))
+		for i, v := range t {
+			result[i] = substituteSymbols(v, replacements)
+		}
+		return result
+	case MalVector:
+		result := make(MalVector, len(t))
+		for i, v := range t {
+			result[i] = substituteSymbols(v, replacements)
+		}
+		return result
+	case MalHashmap:
+		result := make(MalHashmap, len(t))
+		for k, v := range t {
+			result[k] = substituteSymbols(v, replacements)
+		}
+		return result
+	default:
+		return ast
+	}
+}
+
+// shadow returns replacements without the symbols bound by names
+func shadow(replacements map[string]MalType, names MalList) map[string]MalType {
+	result := make(map[string]MalType, len(replacements))
+	for k, v := range replacements {
+		result[k] = v
+	}
+	for _, name := range names {
+		if symbol, ok := name.(MalSymbol); ok {
+			delete(result, symbol.Value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,57 @@
+package mal
+
+import (
+	"testing"
+
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// functions optimized with globals which are redefined afterwards fall back to their bodies
+// as written, so that optimized code never disagrees with the evaluation of the forms
+func TestRedefinitionDeoptimizes(t *testing.T) {
+	for name, opts := range backends {
+		t.Run(name, func(t *testing.T) {
+			in := New(append(opts, WithOptimizer())...)
+			evalString(t, in, "(def! sq (fn* (x) (* x x))) (def! g (fn* (y) (sq y))) (def! h (fn* () (+ 1 2)))")
+			g, err := in.Env().Get(MalSymbol{Value: "g"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "(if (#<builtin optimized?>) (* y y) (sq y))"
+			if got := printer.PrStr(g.(MalFunctionTCO).AST, true); got != want {
+				t.Errorf("the body of g is %s, want %s", got, want)
+			}
+			tests := []struct {
+				src, want string
+			}{
+				{"(g 3)", "9"},
+				{"(h)", "3"},
+				{"(def! sq (fn* (x) 0)) (g 3)", "0"},
+				{"(h)", "3"},
+				{"(def! + -) (h)", "-1"},
+			}
+			for _, test := range tests {
+				if got := evalString(t, in, test.src); got != test.want {
+					t.Errorf("%s = %s, want %s", test.src, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+// (optimize form) only returns the optimized form, the globals it relied on stay free to bind
+func TestOptimizeBuiltin(t *testing.T) {
+	in := New()
+	tests := []struct {
+		src, want string
+	}{
+		{"(def! sq (fn* (x) (* x x))) (optimize (read-string \"(fn* (y) (sq y))\"))", "(fn* (y) (* y y))"},
+		{"(def! sq (fn* (x) 0)) (sq 3)", "0"},
+	}
+	for _, test := range tests {
+		if got := evalString(t, in, test.src); got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package mal
+
+import (
+	"context"
+	"os"
+
+	"github.com/jiayouxujin/mal-go/printer"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// printLimit is *print-length* or *print-level* bound by let*, prn and println called while the
+// body of the let* runs use it, in the functions it calls and the goroutines it starts too
+type printLimit struct {
+	name  string
+	value MalType
+	outer *printLimit
+}
+
+// isPrintLimit tells if sym is *print-length* or *print-level*
+func isPrintLimit(sym MalSymbol) bool {
+	return sym.Value == "*print-length*" || sym.Value == "*print-level*"
+}
+
+// printOptions returns the options of prn and println, the limits bound by let* take precedence
+// over the globals of ns
+func (in *Interp) printOptions(ns *namespace, limits *printLimit, readable bool) printer.Options {
+	opts := printer.OptionsFromEnv(in.globals(ns), readable)
+	var length, level bool
+	for l := limits; l != nil; l = l.outer {
+		switch {
+		case l.name == "*print-length*" && !length:
+			opts.Length, length = printer.Limit(l.value), true
+		case l.name == "*print-level*" && !level:
+			opts.Level, level = printer.Limit(l.value), true
+		}
+	}
+	return opts
+}
+
+// printBuiltin returns prn if readable is set and println otherwise, they print with the limits
+// of the evaluation calling them
+func (in *Interp) printBuiltin(readable bool) MalContextFunction {
+	return func(ctx context.Context, args ...MalType) (MalType, error) {
+		ns, limits := in.currentNamespace(), (*printLimit)(nil)
+		if st, ok := stateFrom(ctx); ok {
+			ns, limits = st.ns, st.printLimits
+		}
+		if err := printer.Fprintln(os.Stdout, in.printOptions(ns, limits, readable), args...); err != nil {
+			return nil, err
+		}
+		return MalNil, nil
+	}
+}
@@ -0,0 +1,150 @@
+package mal
+
+import (
+	"fmt"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// recurArgs is returned by recur to the enclosing loop or function, which runs its body again
+// with them bound
+type recurArgs MalList
+
+// listOf returns the items of a list or a vector, such as the bindings of loop
+func listOf(v MalType) (MalList, bool) {
+	switch t := v.(type) {
+	case MalList:
+		return t, true
+	case MalVector:
+		return MalList(t), true
+	default:
+		return nil, false
+	}
+}
+
+// checkRecur checks that recur is only used in tail position of a loop or function,
+// arity is the number of values recur takes there, or -1 outside of any
+func checkRecur(ast MalType, tail bool, arity int) error {
+	var list MalList
+	switch t := ast.(type) {
+	case MalList:
+		list = t
+	case MalVector:
+		list = MalList(t)
+	case MalHashmap:
+		for _, v := range t {
+			if err := checkRecur(v, false, arity); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	head, _ := list[0].(MalSymbol)
+	if _, ok := ast.(MalList); !ok || SpecialForms[head.Value] == "" {
+		return checkRecurAll(list, arity)
+	}
+	switch head.Value {
+	case "recur":
+		if arity < 0 || !tail {
+			return fmt.Errorf("recur is only allowed in tail position of loop or fn*")
+		}
+		if len(list)-1 != arity {
+			return fmt.Errorf("recur expects %d arguments but gets %d", arity, len(list)-1)
+		}
+		return checkRecurAll(list[1:], arity)
+	case "fn*":
+		if clauses, ok := arityClauses(list); ok {
+			// recur calls the arity it's in again
+			for _, clause := range clauses {
+				c := clause.(MalList)
+				n, rest := arityOf(c[0].(MalVector))
+				if rest {
+					n++
+				}
+				if err := checkRecurBody(c[1:], true, n); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if len(list) != 3 {
+			return nil
+		}
+		params, _ := list[1].(MalList)
+		n := 0
+		for _, p := range params {
+			if p != (MalSymbol{Value: "&"}) {
+				n++
+			}
+		}
+		return checkRecur(list[2], true, n)
+	case "loop":
+		if len(list) < 2 {
+			return nil
+		}
+		bindings, ok := listOf(list[1])
+		if !ok {
+			return nil
+		}
+		for i := 1; i < len(bindings); i += 2 {
+			if err := checkRecur(bindings[i], false, arity); err != nil {
+				return err
+			}
+		}
+		return checkRecurBody(list[2:], true, len(bindings)/2)
+	case "let*":
+		if len(list) != 3 {
+			return nil
+		}
+		bindings, _ := list[1].(MalList)
+		for i := 1; i < len(bindings); i += 2 {
+			if err := checkRecur(bindings[i], false, arity); err != nil {
+				return err
+			}
+		}
+		return checkRecur(list[2], tail, arity)
+	case "do":
+		return checkRecurBody(list[1:], tail, arity)
+	case "if":
+		if len(list) < 2 {
+			return nil
+		}
+		if err := checkRecur(list[1], false, arity); err != nil {
+			return err
+		}
+		for _, branch := range list[2:] {
+			if err := checkRecur(branch, tail, arity); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "go", "future", "dosync":
+		// the body runs on its own, it can't recur to the enclosing loop
+		return checkRecurAll(list[1:], -1)
+	default:
+		return checkRecurAll(list[1:], arity)
+	}
+}
+
+// checkRecurBody checks the body of `do`, only its last form is in tail position
+func checkRecurBody(body MalList, tail bool, arity int) error {
+	for i, form := range body {
+		if err := checkRecur(form, tail && i == len(body)-1, arity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRecurAll(list MalList, arity int) error {
+	for _, v := range list {
+		if err := checkRecur(v, false, arity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
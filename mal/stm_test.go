@@ -0,0 +1,46 @@
+package mal
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// functions called by alter, commute and swap! run in the transaction of dosync
+func TestTransactionReachesCalledFunctions(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"(dosync (alter r (fn* (x) (do (alter r2 + 1) (+ x 1)))))", "2"},
+		{"(deref r2)", "11"},
+		{"(dosync (ref-set r2 100) (alter r (fn* (x) (+ x (deref r2)))))", "102"},
+		{"(dosync (alter r (fn* (x) (do (commute r2 + 1) x))))", "102"},
+		{"(deref r2)", "101"},
+		{"(dosync (swap! a (fn* (x) (do (alter r2 + 1) (deref r2)))))", "102"},
+		{"(deref r2)", "102"},
+	}
+	for name, opts := range backends {
+		t.Run(name, func(t *testing.T) {
+			in := New(opts...)
+			evalString(t, in, "(def! r (ref 1)) (def! r2 (ref 10)) (def! a (atom 0))")
+			for _, test := range tests {
+				if got := evalString(t, in, test.src); got != test.want {
+					t.Errorf("%s = %s, want %s", test.src, got, test.want)
+				}
+			}
+			// the function of commute is applied again on commit, where it can't wait for the refs
+			// nor change the refs commit holds locked
+			for _, src := range []string{
+				"(dosync (commute r (fn* (x) (+ x (deref r2)))))",
+				"(dosync (alter r2 + 1) (commute r (fn* (x) (do (alter r2 + 1) x))))",
+				"(dosync (alter r2 + 1) (commute r (fn* (x) (do (ref-set r2 0) x))))",
+				"(dosync (commute r (fn* (x) (do (commute r2 + 1) x))))",
+			} {
+				if _, err := in.EvalString(context.Background(), src); err != ErrCommitting {
+					t.Errorf("%s fails with %v, want %v", src, err, ErrCommitting)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,405 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"github.com/jiayouxujin/mal-go/env"
+	. "github.com/jiayouxujin/mal-go/types"
+)
+
+// box holds a local captured by closures, nil until it's bound
+type box struct {
+	value MalType
+}
+
+// closure is a compiled function along with the variables it captured and the env of its namespace
+// functions of several arities have a closure for each and no proto
+type closure struct {
+	proto    *proto
+	upvalues []*box
+	arities  []*closure
+	env      *env.Env
+}
+
+// dispatch returns the closure of cl taking argc arguments
+func (cl *closure) dispatch(argc int) (*closure, error) {
+	if cl.arities == nil {
+		if p := cl.proto; p.variadic && argc < p.nparams-1 || !p.variadic && argc != p.nparams {
+			return nil, arityError([]MalType{p.params}, argc)
+		}
+		return cl, nil
+	}
+	var rest *closure
+	for _, a := range cl.arities {
+		if p := a.proto; !p.variadic && p.nparams == argc {
+			return a, nil
+		} else if p.variadic && argc >= p.nparams-1 {
+			rest = a
+		}
+	}
+	if rest != nil {
+		return rest, nil
+	}
+	params := make([]MalType, len(cl.arities))
+	for i, a := range cl.arities {
+		params[i] = MalVector(a.proto.params)
+	}
+	return nil, arityError(params, argc)
+}
+
+type frame struct {
+	cl   *closure
+	ip   int
+	base int // the stack index of slot 0, the function called is right below
+}
+
+// machine runs bytecode on one goroutine, mal functions calling each other don't grow the Go stack
+type machine struct {
+	in     *Interp
+	st     *evalState
+	stack  []MalType
+	frames []frame
+}
+
+// evalVM compiles ast to bytecode and runs it with the globals of e
+func (in *Interp) evalVM(ast MalType, e *env.Env, st *evalState) (res MalType, err error) {
+	p, err := compileSafely(ast)
+	if err != nil {
+		return nil, err
+	}
+	return in.runClosure(&closure{proto: p, env: e}, nil, st)
+}
+
+func compileSafely(ast MalType) (p *proto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	return compile(ast), nil
+}
+
+// function returns the mal value of cl
+func (in *Interp) function(cl *closure) MalFunctionTCO {
+	f := MalFunctionTCO{
+		Env: cl.env,
+		CtxFn: func(ctx context.Context, args ...MalType) (MalType, error) {
+			return in.callback(ctx, func(st *evalState) (MalType, error) {
+				return in.runClosure(cl, args, st)
+			})
+		},
+		Compiled: cl,
+	}
+	if cl.arities == nil {
+		f.AST, f.Params = cl.proto.ast, cl.proto.params
+		return f
+	}
+	clauses := make(MalList, len(cl.arities))
+	f.Arities = make([]MalVector, len(cl.arities))
+	for i, a := range cl.arities {
+		f.Arities[i] = MalVector(a.proto.params)
+		clauses[i] = MalList{f.Arities[i], a.proto.ast}
+	}
+	f.AST = clauses
+	return f
+}
+
+// runClosure calls cl with args on a new machine
+func (in *Interp) runClosure(cl *closure, args MalList, st *evalState) (MalType, error) {
+	m := &machine{in: in, st: st, stack: make([]MalType, 0, 64)}
+	m.stack = append(append(m.stack, MalNil), args...)
+	if err := m.call(cl, len(args)); err != nil {
+		return nil, err
+	}
+	limits := st.printLimits
+	res, err := m.run()
+	// an error may leave print limits bound
+	st.printLimits = limits
+	return res, err
+}
+
+func (m *machine) push(v MalType) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *machine) pop() MalType {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+func (m *machine) top() MalType {
+	return m.stack[len(m.stack)-1]
+}
+
+// popN pops the n values on top of the stack
+func (m *machine) popN(n int) MalList {
+	values := append(MalList(nil), m.stack[len(m.stack)-n:]...)
+	m.stack = m.stack[:len(m.stack)-n]
+	return values
+}
+
+// call pushes the frame calling cl with the argc arguments on top of the stack
+func (m *machine) call(cl *closure, argc int) error {
+	cl, err := cl.dispatch(argc)
+	if err != nil {
+		return err
+	}
+	p := cl.proto
+	base := len(m.stack) - argc
+	if p.variadic {
+		// the rest of the arguments go to the last slot
+		rest := m.popN(argc - (p.nparams - 1))
+		if rest == nil {
+			rest = MalList{}
+		}
+		m.push(rest)
+	}
+	if err := m.st.enter(); err != nil {
+		return err
+	}
+	for len(m.stack) < base+p.nslots {
+		m.push(nil)
+	}
+	m.frames = append(m.frames, frame{cl: cl, base: base})
+	return nil
+}
+
+// ret pops the current frame, it returns true when the machine is done
+func (m *machine) ret(v MalType) bool {
+	f := m.frames[len(m.frames)-1]
+	m.frames = m.frames[:len(m.frames)-1]
+	m.stack = m.stack[:f.base-1]
+	m.st.leave()
+	if len(m.frames) == 0 {
+		return true
+	}
+	m.push(v)
+	return false
+}
+
+// fail unwinds all frames
+func (m *machine) fail(err error) (MalType, error) {
+	for range m.frames {
+		m.st.leave()
+	}
+	m.frames = nil
+	return nil, err
+}
+
+// closure creates a closure of protos[i] of the current frame
+func (m *machine) closure(f *frame, i int) *closure {
+	p := f.cl.proto.protos[i]
+	cl := &closure{proto: p, upvalues: make([]*box, len(p.upvalues)), env: f.cl.env}
+	for i, u := range p.upvalues {
+		if u.local {
+			cl.upvalues[i] = m.stack[f.base+u.index].(*box)
+		} else {
+			cl.upvalues[i] = f.cl.upvalues[u.index]
+		}
+	}
+	return cl
+}
+
+func (m *machine) run() (MalType, error) {
+	for {
+		f := &m.frames[len(m.frames)-1]
+		p := f.cl.proto
+		op := opcode(p.code[f.ip])
+		f.ip++
+		operand := func() int {
+			v := int(p.code[f.ip])<<8 | int(p.code[f.ip+1])
+			f.ip += 2
+			return v
+		}
+		switch op {
+		case opConst:
+			m.push(p.consts[operand()])
+		case opGlobal:
+			g := operand()
+			v, err := f.cl.env.GetID(p.ids[g])
+			if err != nil {
+				return m.fail(fmt.Errorf("failed to look up '%s' in environments", p.globals[g].Value))
+			}
+			m.push(v)
+		case opDefGlobal:
+			if err := f.cl.env.Set(p.globals[operand()], m.top()); err != nil {
+				return m.fail(err)
+			}
+		case opLocal:
+			m.push(m.stack[f.base+operand()])
+		case opSetLocal:
+			m.stack[f.base+operand()] = m.top()
+		case opBoxed:
+			m.push(m.stack[f.base+operand()].(*box).value)
+		case opSetBoxed:
+			m.stack[f.base+operand()].(*box).value = m.top()
+		case opBox:
+			s := f.base + operand()
+			m.stack[s] = &box{value: m.stack[s]}
+		case opNewBox:
+			m.stack[f.base+operand()] = &box{}
+		case opNop:
+			f.ip += 2
+		case opUpvalue:
+			u := operand()
+			v := f.cl.upvalues[u].value
+			if v == nil { // a let* binding which isn't bound yet
+				name := p.upvalues[u].name
+				var err error
+				if v, err = f.cl.env.Get(name); err != nil {
+					return m.fail(fmt.Errorf("failed to look up '%s' in environments", name.Value))
+				}
+			}
+			m.push(v)
+		case opName:
+			name := p.consts[operand()].(MalSymbol)
+			if fn, ok := m.top().(MalFunctionTCO); ok && fn.Name == "" {
+				fn.Name = name.Value
+				m.stack[len(m.stack)-1] = fn
+			}
+		case opPop:
+			m.pop()
+		case opJump:
+			f.ip = operand()
+		case opRecur:
+			if err := m.st.enter(); err != nil {
+				return m.fail(err)
+			}
+			m.st.leave()
+			f.ip = operand()
+		case opJumpIfFalse:
+			a := operand()
+			if v := m.pop(); v == MalFalse || v == MalNil {
+				f.ip = a
+			}
+		case opClosure:
+			m.push(m.in.function(m.closure(f, operand())))
+		case opArities:
+			first, n := operand(), operand()
+			cl := &closure{arities: make([]*closure, n), env: f.cl.env}
+			for i := range cl.arities {
+				cl.arities[i] = m.closure(f, first+i)
+			}
+			m.push(m.in.function(cl))
+		case opCall, opTailCall:
+			n := operand()
+			fnIndex := len(m.stack) - n - 1
+			if fn, ok := m.stack[fnIndex].(MalFunctionTCO); ok {
+				if cl, ok := fn.Compiled.(*closure); ok {
+					if op == opTailCall {
+						// move the function and its arguments over the frame of the caller
+						copy(m.stack[f.base-1:], m.stack[fnIndex:])
+						m.stack = m.stack[:f.base+n]
+						m.frames = m.frames[:len(m.frames)-1]
+						m.st.leave()
+					}
+					if err := m.call(cl, n); err != nil {
+						return m.fail(err)
+					}
+					continue
+				}
+			}
+			args := m.popN(n)
+			v, err := m.in.apply(m.pop(), args, m.st)
+			if err != nil {
+				return m.fail(err)
+			}
+			if op == opCall {
+				m.push(v)
+			} else if m.ret(v) {
+				return v, nil
+			}
+		case opReturn:
+			if v := m.pop(); m.ret(v) {
+				return v, nil
+			}
+		case opVector:
+			m.push(MalVector(m.popN(operand())))
+		case opHashmap:
+			kvs := m.popN(2 * operand())
+			hm := make(MalHashmap, len(kvs)/2)
+			for i := 0; i < len(kvs); i += 2 {
+				hm[kvs[i]] = kvs[i+1]
+			}
+			m.push(hm)
+		case opGo:
+			cl, child := m.closure(f, operand()), m.st.fork()
+			ch := NewChannel(1)
+			go func() {
+				defer ch.Close()
+				v, err := m.in.runClosure(cl, nil, child)
+				goResult(ch, child, v, err)
+			}()
+			m.push(ch)
+		case opFuture:
+			cl, child := m.closure(f, operand()), m.st.fork()
+			fut := NewFuture()
+			go func() {
+				v, err := m.in.runClosure(cl, nil, child)
+				if v == nil {
+					v = MalNil
+				}
+				fut.Deliver(v, err)
+			}()
+			m.push(fut)
+		case opDosync:
+			cl := m.closure(f, operand())
+			var v MalType
+			var err error
+			if TxnFrom(m.st.ctx) != nil { // nested transactions join the running one
+				v, err = m.in.runClosure(cl, nil, m.st)
+			} else {
+				v, err = RunTxn(func(txn *Txn) (MalType, error) {
+					return m.in.runClosure(cl, nil, m.st.withContext(WithTxn(m.st.ctx, txn)))
+				})
+			}
+			if err != nil {
+				return m.fail(err)
+			}
+			m.push(v)
+		case opMethod:
+			name, n := p.consts[operand()].(MalString), operand()
+			args := m.popN(n)
+			v, err := CallMethod(m.pop(), name.Value, args...)
+			if err != nil {
+				return m.fail(err)
+			}
+			m.push(v)
+		case opField:
+			name := p.consts[operand()].(MalString)
+			v, err := GetField(m.pop(), name.Value)
+			if err != nil {
+				return m.fail(err)
+			}
+			m.push(v)
+		case opQualified:
+			v, err := p.consts[operand()].(qualified).get()
+			if err != nil {
+				return m.fail(err)
+			}
+			m.push(v)
+		case opNamespace:
+			v, err := m.in.namespaceForm(p.consts[operand()].(MalList), m.st)
+			if err != nil {
+				return m.fail(err)
+			}
+			m.push(v)
+		case opBindLimit:
+			name := p.consts[operand()].(MalSymbol)
+			m.st.printLimits = &printLimit{name: name.Value, value: m.pop(), outer: m.st.printLimits}
+		case opUnbindLimits:
+			for n := operand(); n > 0; n-- {
+				m.st.printLimits = m.st.printLimits.outer
+			}
+		case opFail:
+			return m.fail(fmt.Errorf("%s", p.consts[operand()].(MalString).Value))
+		default:
+			return m.fail(fmt.Errorf("invalid instruction %d", op))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// backends are the options selecting each evaluator, tests of features both implement
+// run on every one of them
+var backends = map[string][]Option{
+	"tree": nil,
+	"vm":   {WithVM()},
+}
+
+func TestVMTailCalls(t *testing.T) {
+	// the recursive calls are in tail position of nested if, do and let*, so they run
+	// in the frame of the caller and don't count against MaxDepth
+	in := New(WithVM(), WithLimits(Limits{MaxDepth: 20}))
+	tests := []struct {
+		src, want string
+	}{
+		{`(do (def! countdown (fn* (n acc) (if (= n 0) acc (do (if (> n 5000) (countdown (- n 1) (+ acc 1)) (let* (m (- n 1)) (countdown m (+ acc 1)))))))) (countdown 10000 0))`, "10000"},
+		{`(do (def! even? (fn* (n) (if (= n 0) true (odd? (- n 1))))) (def! odd? (fn* (n) (if (= n 0) false (even? (- n 1))))) (even? 10001))`, "false"},
+		{"(do (def! spread (fn* (n & xs) (if (= n 0) (count xs) (spread (- n 1) n n)))) (spread 10000))", "2"},
+	}
+	for _, test := range tests {
+		if got := evalString(t, in, test.src); got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+	// the call in the condition of if isn't in tail position
+	src := "(do (def! deep (fn* (n) (if (if (= n 0) true (deep (- n 1))) 0 1))) (deep 100))"
+	if _, err := in.EvalString(context.Background(), src); err != ErrDepthLimit {
+		t.Errorf("%s fails with %v, want %v", src, err, ErrDepthLimit)
+	}
+}
+
+func TestVMClosures(t *testing.T) {
+	in := New(WithVM())
+	tests := []struct {
+		src, want string
+	}{
+		// parameters captured by closures live in boxes which outlive the frame
+		{"((fn* (n) ((fn* () n))) 1)", "1"},
+		{"(do (def! adder (fn* (n) (fn* (x) (+ x n)))) [((adder 10) 1) ((adder 20) 1)])", "[11 21]"},
+		// upvalues of upvalues
+		{"((((fn* (a) (fn* (b) (fn* (c) [a b c]))) 1) 2) 3)", "[1 2 3]"},
+		{"(let* (a 1) ((fn* () (let* (b 2) ((fn* () (+ a b)))))))", "3"},
+		// each call gets its own slots
+		{"(do (def! mk (fn* (n) (fn* () n))) (let* (a (mk 1) b (mk 2)) [(a) (b)]))", "[1 2]"},
+		// a let* binding captured before it's bound, for local recursive functions
+		{"(let* (f (fn* (n) (if (= n 0) :done (f (- n 1))))) (f 10))", ":done"},
+		{"(let* (a 1 a (+ a 1) f (fn* () a)) (f))", "2"},
+	}
+	for _, test := range tests {
+		if got := evalString(t, in, test.src); got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestVMCompileErrors(t *testing.T) {
+	in := New(WithVM())
+	// malformed forms compile to a failure, so they fail only when they're evaluated
+	if got := evalString(t, in, "(do (def! f (fn* () (if))) (if false (f) 1))"); got != "1" {
+		t.Errorf("f = %s, want 1", got)
+	}
+	big := fmt.Sprintf("(list %s)", strings.Repeat(`"x" `, maxOperand+1))
+	tests := []struct {
+		src, want string
+	}{
+		{"(f)", "incorrect number of arguments for 'if'"},
+		{"(let* (1 2) 3)", "invalid binding form 1"},
+		{"(fn* (a & b c) a)", "invalid position for '&' in bindings"},
+		{big, "function too large to compile"},
+	}
+	for _, test := range tests {
+		_, err := in.EvalString(context.Background(), test.src)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%.40s fails with %v, want %s", test.src, err, test.want)
+		}
+	}
+}
+
+func TestVMRecur(t *testing.T) {
+	in := New(WithVM(), WithLimits(Limits{MaxDepth: 20}))
+	tests := []struct {
+		src, want string
+	}{
+		// recur in tail position of nested if, do and let* jumps back without a call
+		{"(loop [i 0] (if (< i 10000) (do (if (= i -1) :never (let* (j (+ i 1)) (recur j)))) i))", "10000"},
+		{"((fn* (n acc) (if (= n 0) acc (do acc (if (= n (* 2 (/ n 2))) (recur (- n 1) (+ acc 1)) (recur (- n 1) acc))))) 10000 0)", "5000"},
+		// a loop in a function and a loop in a loop have their own targets
+		{"((fn* (n) (loop [i 0] (if (< i n) (recur (+ i 1)) [n i]))) 3)", "[3 3]"},
+		{"(loop [i 0 n 0] (if (= i 3) n (recur (+ i 1) (loop [j 0 n n] (if (= j 3) n (recur (+ j 1) (+ n 1)))))))", "9"},
+		// closures capture the bindings of one iteration, not the slots reused by the next
+		{"(loop [i 0 f nil] (if (= i 3) (f) (recur (+ i 1) (fn* () i))))", "2"},
+	}
+	for _, test := range tests {
+		if got := evalString(t, in, test.src); got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
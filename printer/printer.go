@@ -1,59 +1,306 @@
 package printer
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/jiayouxujin/mal-go/types"
+	"io"
+	"sort"
 	"strconv"
+	"strings"
 )
 
-func printList(lst types.MalList, start, end string, readable bool) string {
-	result := start
+// Unlimited disables the print-length or print-level limit
+const Unlimited = -1
+
+// Options controls how values are printed
+// Length is the max number of items printed for each collection and
+// Level is the max depth of nested collections, anything beyond them is printed as `...`
+type Options struct {
+	Readable bool
+	Length   int
+	Level    int
+}
+
+// OptionsFromEnv builds options from `*print-length*` and `*print-level*` in env
+func OptionsFromEnv(env types.MalEnv, readable bool) Options {
+	limit := func(name string) int {
+		if env == nil {
+			return Unlimited
+		}
+		v, err := env.Get(types.MalSymbol{Value: name})
+		if err != nil {
+			return Unlimited
+		}
+		return Limit(v)
+	}
+	return Options{
+		Readable: readable,
+		Length:   limit("*print-length*"),
+		Level:    limit("*print-level*"),
+	}
+}
+
+// Limit returns the limit set by v, the value of `*print-length*` or `*print-level*`, anything
+// but a non-negative number is Unlimited
+func Limit(v types.MalType) int {
+	if n, ok := v.(types.MalNumber); ok && n.Value >= 0 {
+		return n.Value
+	}
+	return Unlimited
+}
+
+// Hook prints values unknown to the printer, it returns false if data isn't handled
+type Hook func(w io.Writer, data types.MalType, opts Options) bool
+
+var hooks []Hook
+
+// RegisterHook adds a hook to print values of other types, later hooks take precedence
+func RegisterHook(hook Hook) {
+	hooks = append(hooks, hook)
+}
+
+type printer struct {
+	w    *bufio.Writer
+	opts Options
+	// printing holds the atoms, refs, agents, futures and promises whose values are being printed
+	printing map[types.MalType]bool
+}
+
+// Fprint writes the representation of data to w
+func Fprint(w io.Writer, data types.MalType, opts Options) error {
+	p := printer{w: bufio.NewWriter(w), opts: opts}
+	p.print(data, 0)
+	return p.w.Flush()
+}
+
+// Fprintln writes the representations of values separated by spaces and followed by a newline to w
+func Fprintln(w io.Writer, opts Options, values ...types.MalType) error {
+	p := printer{w: bufio.NewWriter(w), opts: opts}
+	for index, v := range values {
+		if index != 0 {
+			p.w.WriteByte(' ')
+		}
+		p.print(v, 0)
+	}
+	p.w.WriteByte('\n')
+	return p.w.Flush()
+}
+
+// PrStr returns the representation of data without any limit
+func PrStr(data types.MalType, readable bool) string {
+	var sb strings.Builder
+	_ = Fprint(&sb, data, Options{Readable: readable, Length: Unlimited, Level: Unlimited})
+	return sb.String()
+}
+
+// tooLong reports whether the index-th item of a collection exceeds print-length
+func (p *printer) tooLong(index int) bool {
+	return p.opts.Length != Unlimited && index >= p.opts.Length
+}
+
+// tooDeep reports whether a collection at level exceeds print-level
+func (p *printer) tooDeep(level int) bool {
+	return p.opts.Level != Unlimited && level >= p.opts.Level
+}
+
+func (p *printer) printList(lst types.MalList, start, end string, level int) {
+	if p.tooDeep(level) {
+		p.w.WriteString("...")
+		return
+	}
+	p.w.WriteString(start)
 	for index, item := range lst {
 		if index != 0 {
-			result += " "
+			p.w.WriteByte(' ')
 		}
-		result += PrStr(item, readable)
+		if p.tooLong(index) {
+			p.w.WriteString("...")
+			break
+		}
+		p.print(item, level+1)
+	}
+	p.w.WriteString(end)
+}
+
+// keyRank orders keys of different types: numbers < strings < keywords < symbols < others
+func keyRank(key types.MalType) int {
+	switch key.(type) {
+	case types.MalNumber:
+		return 0
+	case types.MalString:
+		return 1
+	case types.MalKeyword:
+		return 2
+	case types.MalSymbol:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// keyLess is a total order over hashmap keys, so that maps always print the same way
+func keyLess(a, b types.MalType) bool {
+	if ra, rb := keyRank(a), keyRank(b); ra != rb {
+		return ra < rb
+	}
+	switch x := a.(type) {
+	case types.MalNumber:
+		return x.Value < b.(types.MalNumber).Value
+	case types.MalString:
+		return x.Value < b.(types.MalString).Value
+	case types.MalKeyword:
+		return x.Value < b.(types.MalKeyword).Value
+	case types.MalSymbol:
+		return x.Value < b.(types.MalSymbol).Value
+	default:
+		return PrStr(a, true) < PrStr(b, true)
+	}
+}
+
+// SortedKeys returns the keys of `hm` sorted by keyLess
+func SortedKeys(hm types.MalHashmap) []types.MalType {
+	keys := make([]types.MalType, 0, len(hm))
+	for k := range hm {
+		keys = append(keys, k)
 	}
-	result += end
-	return result
+	sort.Slice(keys, func(i, j int) bool {
+		return keyLess(keys[i], keys[j])
+	})
+	return keys
 }
 
-func printHashmap(hm types.MalHashmap, readable bool) string {
-	result := "{"
-	flag := true
-	for k, v := range hm {
-		if !flag {
-			result += " "
+func (p *printer) printHashmap(hm types.MalHashmap, level int) {
+	if p.tooDeep(level) {
+		p.w.WriteString("...")
+		return
+	}
+	p.w.WriteByte('{')
+	for index, k := range SortedKeys(hm) {
+		if index != 0 {
+			p.w.WriteByte(' ')
+		}
+		if p.tooLong(index) {
+			p.w.WriteString("...")
+			break
 		}
-		flag = false
-		result += PrStr(k, readable)
-		result += " "
-		result += PrStr(v, readable)
+		p.print(k, level+1)
+		p.w.WriteByte(' ')
+		p.print(hm[k], level+1)
 	}
-	result += "}"
-	return result
+	p.w.WriteByte('}')
 }
-func PrStr(data types.MalType, readable bool) string {
+
+func (p *printer) print(data types.MalType, level int) {
 	switch t := data.(type) {
 	case types.MalNumber:
-		return strconv.Itoa(t.Value)
+		p.w.WriteString(strconv.Itoa(t.Value))
 	case types.MalSymbol:
-		return t.Value
+		p.w.WriteString(t.Value)
 	case types.MalString:
-		if readable {
-			return strconv.Quote(t.Value)
+		if p.opts.Readable {
+			p.w.WriteString(strconv.Quote(t.Value))
+		} else {
+			p.w.WriteString(t.Value)
 		}
-		return t.Value
 	case types.MalLiteral:
-		return string(t)
+		p.w.WriteString(string(t))
 	case types.MalKeyword:
-		return ":" + t.Value
+		p.w.WriteString(":" + t.Value)
 	case types.MalList: //(foo bar)
-		return printList(t, "(", ")", readable)
+		p.printList(t, "(", ")", level)
 	case types.MalVector: //[foo bar]
-		return printList(types.MalList(t), "[", "]", readable)
+		p.printList(types.MalList(t), "[", "]", level)
 	case types.MalHashmap:
-		return printHashmap(t, readable)
+		p.printHashmap(t, level)
+	case types.MalBuiltin:
+		p.w.WriteString("#<builtin " + t.Name + ">")
+	case types.MalFunction:
+		p.w.WriteString("#<builtin>")
+	case types.MalFunctionTCO:
+		p.w.WriteString("#<fn ")
+		if t.Name != "" {
+			p.w.WriteString(t.Name + " ")
+		}
+		if t.Arities != nil {
+			arities := make(types.MalList, len(t.Arities))
+			for i, params := range t.Arities {
+				arities[i] = params
+			}
+			p.printList(arities, "(", ")", 0)
+		} else {
+			p.printList(t.Params, "(", ")", 0)
+		}
+		p.w.WriteByte('>')
+	case *types.MalAtom:
+		p.printRef(t, "(atom ", ")", t.Deref, level)
+	case *types.MalRef:
+		p.printRef(t, "#<ref ", ">", t.Deref, level)
+	case *types.MalAgent:
+		p.printRef(t, "#<agent ", ">", t.Deref, level)
+	case *types.MalChannel:
+		p.w.WriteString("#<chan>")
+	case *types.MalFuture:
+		p.printPending(t, "future", t.Peek)
+	case *types.MalPromise:
+		p.printPending(t, "promise", t.Peek)
+	case types.MalGoValue:
+		p.printUnknown(t.Value)
 	default:
-		return "/UNKNOWN VALUE/"
+		p.printUnknown(data)
+	}
+}
+
+// enter marks ref as being printed, it returns false if it is already, the value of ref holds
+// ref itself then and is printed as ...
+func (p *printer) enter(ref types.MalType) bool {
+	if p.printing[ref] {
+		p.w.WriteString("...")
+		return false
+	}
+	if p.printing == nil {
+		p.printing = make(map[types.MalType]bool)
+	}
+	p.printing[ref] = true
+	return true
+}
+
+func (p *printer) leave(ref types.MalType) {
+	delete(p.printing, ref)
+}
+
+// printRef prints an atom, ref or agent with its value
+func (p *printer) printRef(ref types.MalType, start, end string, deref func() types.MalType, level int) {
+	if !p.enter(ref) {
+		return
+	}
+	defer p.leave(ref)
+	p.w.WriteString(start)
+	p.print(deref(), level+1)
+	p.w.WriteString(end)
+}
+
+// printPending prints a future or promise with its value if it's delivered
+func (p *printer) printPending(ref types.MalType, kind string, peek func() (types.MalType, bool)) {
+	if !p.enter(ref) {
+		return
+	}
+	defer p.leave(ref)
+	p.w.WriteString("#<" + kind + " ")
+	if v, ok := peek(); ok {
+		p.print(v, 0)
+	} else {
+		p.w.WriteString(":pending")
+	}
+	p.w.WriteByte('>')
+}
+
+// printUnknown tries the registered hooks and falls back to the Go type name
+func (p *printer) printUnknown(data types.MalType) {
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hooks[i](p.w, data, p.opts) {
+			return
+		}
 	}
+	fmt.Fprintf(p.w, "#<go %T>", data)
 }
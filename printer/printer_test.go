@@ -0,0 +1,32 @@
+package printer
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jiayouxujin/mal-go/types"
+)
+
+type point struct{ x, y int }
+
+type other struct{}
+
+func TestPrintGoValues(t *testing.T) {
+	if got := PrStr(other{}, true); got != "#<go printer.other>" {
+		t.Errorf("PrStr(other{}) = %s, want #<go printer.other>", got)
+	}
+	RegisterHook(func(w io.Writer, data types.MalType, opts Options) bool {
+		p, ok := data.(point)
+		if ok {
+			fmt.Fprintf(w, "#<point %d %d>", p.x, p.y)
+		}
+		return ok
+	})
+	if got := PrStr(types.MalList{point{1, 2}}, true); got != "(#<point 1 2>)" {
+		t.Errorf("PrStr((point)) = %s, want (#<point 1 2>)", got)
+	}
+	if got := PrStr(other{}, true); got != "#<go printer.other>" {
+		t.Errorf("PrStr(other{}) = %s, want #<go printer.other> once a hook is registered", got)
+	}
+}
@@ -69,6 +69,27 @@ func ReadStr(input string) (MalType, error) {
 	return readForm(&r)
 }
 
+// ReadAll reads all forms in input
+func ReadAll(input string) ([]MalType, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	r := TokenReader{
+		tokens:   tokens,
+		position: 0,
+	}
+	forms := make([]MalType, 0)
+	for r.position < len(r.tokens) {
+		form, err := readForm(&r)
+		if err != nil {
+			return nil, err
+		}
+		forms = append(forms, form)
+	}
+	return forms, nil
+}
+
 func tokenize(input string) ([]string, error) {
 	re, err := regexp.Compile(tokenRegexp)
 	if err != nil {
@@ -152,10 +173,10 @@ func readHashmap(t *TokenReader) (MalType, error) {
 	res := make(MalHashmap)
 	for i := 0; i < len(tmp); i += 2 {
 		switch t := tmp[i].(type) {
-		case MalKeyword, MalString:
+		case MalKeyword, MalString, MalSymbol: // symbols are keys of destructuring patterns
 			res[t] = tmp[i+1]
 		default:
-			return nil, fmt.Errorf("hashmap keys only accept string of keyword")
+			return nil, fmt.Errorf("hashmap keys only accept string, keyword or symbol")
 		}
 	}
 	return res, nil
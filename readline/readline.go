@@ -1,29 +1,120 @@
 package readline
 
 import (
+	"bufio"
 	"github.com/peterh/liner"
 	"os"
 	"path/filepath"
+	"strings"
+	"unicode"
 )
 
+// DefaultHistorySize is the max number of history entries kept by default
+const DefaultHistorySize = 1000
+
+// Options configures the line editor
+type Options struct {
+	// HistoryFile is where the history is kept, an empty path disables persistent history
+	HistoryFile string
+	// HistorySize is the max number of entries kept in the history
+	HistorySize int
+}
+
 var (
-	historyFile = filepath.Join(os.TempDir(), ".mal_history")
-	line        *liner.State
+	options Options
+	line    *liner.State
+	// history is the deduplicated history written back on Close, the oldest entry first
+	history []string
 )
 
-func init() {
+// DefaultHistoryFile returns $MAL_HISTORY if set, otherwise mal/history under
+// $XDG_STATE_HOME, which defaults to ~/.local/state
+func DefaultHistoryFile() string {
+	if file := os.Getenv("MAL_HISTORY"); file != "" {
+		return file
+	}
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(stateHome, "mal", "history")
+}
+
+// addHistory appends item to history, dropping its previous occurrence and the oldest
+// entries beyond the size limit
+func addHistory(item string) {
+	for i, h := range history {
+		if h == item {
+			history = append(history[:i], history[i+1:]...)
+			break
+		}
+	}
+	history = append(history, item)
+	if len(history) > options.HistorySize {
+		history = history[len(history)-options.HistorySize:]
+	}
+}
+
+// Open starts the line editor and loads the history
+func Open(opts Options) {
+	options = opts
+	if options.HistorySize <= 0 {
+		options.HistorySize = DefaultHistorySize
+	}
 	line = liner.NewLiner()
 	line.SetCtrlCAborts(true)
+	if options.HistoryFile == "" {
+		return
+	}
 	//load history from file
-	if f, err := os.Open(historyFile); err == nil {
-		_, _ = line.ReadHistory(f)
+	if f, err := os.Open(options.HistoryFile); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			addHistory(scanner.Text())
+		}
 		_ = f.Close()
 	}
+	for _, h := range history {
+		line.AppendHistory(h)
+	}
+}
+
+// Completer returns the candidates for the word before the cursor
+type Completer func(word string) []string
+
+// isDelimiter reports whether r ends a mal symbol or keyword
+func isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("()[]{}'\"`~@^,;", r)
+}
+
+// SetCompleter installs f to complete the symbol or keyword under the cursor on Tab
+func SetCompleter(f Completer) {
+	line.SetTabCompletionStyle(liner.TabPrints)
+	line.SetWordCompleter(func(input string, pos int) (string, []string, string) {
+		runes := []rune(input)
+		start := pos
+		for start > 0 && !isDelimiter(runes[start-1]) {
+			start--
+		}
+		return string(runes[:start]), f(string(runes[start:pos])), string(runes[pos:])
+	})
 }
 
 func Close() {
-	if f, err := os.Create(historyFile); err == nil {
-		_, _ = line.WriteHistory(f)
+	if options.HistoryFile != "" {
+		_ = os.MkdirAll(filepath.Dir(options.HistoryFile), 0700)
+		if f, err := os.OpenFile(options.HistoryFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
+			w := bufio.NewWriter(f)
+			for _, h := range history {
+				_, _ = w.WriteString(h + "\n")
+			}
+			_ = w.Flush()
+			_ = f.Close()
+		}
 	}
 	_ = line.Close()
 }
@@ -33,6 +124,9 @@ func PromptAndRead(prompt string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	line.AppendHistory(input)
+	if strings.TrimSpace(input) != "" {
+		line.AppendHistory(input)
+		addHistory(input)
+	}
 	return input, nil
 }
@@ -0,0 +1,58 @@
+package readline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setenv sets the environment variable key to value until the test finishes
+func setenv(t *testing.T, key, value string) {
+	prev, ok := os.LookupEnv(key)
+	_ = os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, prev)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+func TestDefaultHistoryFile(t *testing.T) {
+	setenv(t, "MAL_HISTORY", "")
+	setenv(t, "XDG_STATE_HOME", "/state")
+	if got := DefaultHistoryFile(); got != "/state/mal/history" {
+		t.Errorf("DefaultHistoryFile() = %s, want /state/mal/history", got)
+	}
+	setenv(t, "MAL_HISTORY", "/tmp/h")
+	if got := DefaultHistoryFile(); got != "/tmp/h" {
+		t.Errorf("DefaultHistoryFile() = %s with MAL_HISTORY set, want /tmp/h", got)
+	}
+}
+
+// the history is loaded on Open and written back deduplicated and capped on Close
+func TestHistoryFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state", "history")
+	Open(Options{HistoryFile: file, HistorySize: 2})
+	addHistory("(+ 1 2)")
+	Close()
+	if content, err := ioutil.ReadFile(file); err != nil || string(content) != "(+ 1 2)\n" {
+		t.Fatalf("history file contains %q, %v", content, err)
+	}
+	if err := ioutil.WriteFile(file, []byte("a\nb\na\nc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	history = nil
+	Open(Options{HistoryFile: file, HistorySize: 2})
+	addHistory("c")
+	Close()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "a\nc\n" {
+		t.Errorf("history file contains %q, want %q", content, "a\nc\n")
+	}
+}
@@ -0,0 +1,255 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDerefTimeout is returned by Wait when the timeout elapses before the value is delivered
+var ErrDerefTimeout = errors.New("deref timed out")
+
+// Deref returns the value of the atom
+func (a *MalAtom) Deref() MalType {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Value
+}
+
+// Reset sets the value of the atom to v
+func (a *MalAtom) Reset(v MalType) MalType {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Value = v
+	a.version++
+	return v
+}
+
+// Swap sets the value of the atom to f(old value), f is retried if the atom changes meanwhile
+func (a *MalAtom) Swap(f func(old MalType) (MalType, error)) (MalType, error) {
+	for {
+		a.mu.Lock()
+		old, version := a.Value, a.version
+		a.mu.Unlock()
+		v, err := f(old)
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		if a.version == version {
+			a.Value = v
+			a.version++
+			a.mu.Unlock()
+			return v, nil
+		}
+		a.mu.Unlock()
+	}
+}
+
+// NewChannel creates a channel with a buffer of size
+func NewChannel(size int) *MalChannel {
+	return &MalChannel{Ch: make(chan MalType, size)}
+}
+
+// Closed reports whether the channel is closed
+func (c *MalChannel) Closed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+// Close closes the channel, it's a no-op if the channel is already closed
+func (c *MalChannel) Close() {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.Ch)
+	}
+}
+
+// Put sends v on the channel, it returns false if the channel is closed
+func (c *MalChannel) Put(ctx context.Context, v MalType) (ok bool, err error) {
+	if c.Closed() {
+		return false, nil
+	}
+	defer func() {
+		// the channel may be closed while blocking on sending
+		if r := recover(); r != nil {
+			ok, err = false, nil
+		}
+	}()
+	select {
+	case c.Ch <- v:
+		return true, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// Take receives a value from the channel, it returns nil once the channel is closed and drained
+func (c *MalChannel) Take(ctx context.Context) (MalType, error) {
+	select {
+	case v, ok := <-c.Ch:
+		if !ok {
+			return MalNil, nil
+		}
+		return v, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pending is a value which is delivered once, waiting for it blocks until then
+type pending struct {
+	once  sync.Once
+	done  chan struct{}
+	value MalType
+	err   error
+}
+
+func newPending() pending {
+	return pending{done: make(chan struct{})}
+}
+
+// NewFuture creates a future, which is realized by Deliver once its computation finishes
+func NewFuture() *MalFuture {
+	return &MalFuture{pending: newPending()}
+}
+
+// NewPromise creates a promise to be delivered
+func NewPromise() *MalPromise {
+	return &MalPromise{pending: newPending()}
+}
+
+// Deliver sets the value or error, it returns false if it's already delivered
+func (p *pending) Deliver(v MalType, err error) bool {
+	delivered := false
+	p.once.Do(func() {
+		p.value, p.err = v, err
+		close(p.done)
+		delivered = true
+	})
+	return delivered
+}
+
+// Realized reports whether the value is delivered
+func (p *pending) Realized() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Peek returns the value if it's delivered
+func (p *pending) Peek() (MalType, bool) {
+	if !p.Realized() {
+		return nil, false
+	}
+	return p.value, true
+}
+
+// Wait blocks until the value is delivered, ctx is done or the timeout elapses
+// a negative timeout waits forever
+func (p *pending) Wait(ctx context.Context, timeout time.Duration) (MalType, error) {
+	if v, ok := p.Peek(); ok {
+		return v, p.err
+	}
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-p.done:
+		return p.value, p.err
+	case <-expired:
+		return nil, ErrDerefTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NewAgent creates an agent holding v
+func NewAgent(v MalType) *MalAgent {
+	return &MalAgent{state: v}
+}
+
+// Deref returns the current state of the agent
+func (a *MalAgent) Deref() MalType {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// Error returns the error of the failed action, the agent rejects new actions once one fails
+func (a *MalAgent) Error() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Send queues the action which sets the state to f(state), actions run one at a time on another goroutine
+func (a *MalAgent) Send(f func(state MalType) (MalType, error)) error {
+	return a.enqueue(func() {
+		a.mu.Lock()
+		state, failed := a.state, a.err != nil
+		a.mu.Unlock()
+		if failed {
+			return
+		}
+		v, err := f(state)
+		a.mu.Lock()
+		if err != nil {
+			a.err = err
+		} else {
+			a.state = v
+		}
+		a.mu.Unlock()
+	})
+}
+
+// Await blocks until all the actions sent so far are done
+func (a *MalAgent) Await(ctx context.Context) error {
+	done := make(chan struct{})
+	if err := a.enqueue(func() { close(done) }); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *MalAgent) enqueue(action func()) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return fmt.Errorf("agent is failed: %v", a.err)
+	}
+	a.queue = append(a.queue, action)
+	if !a.running {
+		a.running = true
+		go a.run()
+	}
+	return nil
+}
+
+// run runs the queued actions until the queue is empty
+func (a *MalAgent) run() {
+	for {
+		a.mu.Lock()
+		if len(a.queue) == 0 {
+			a.running = false
+			a.mu.Unlock()
+			return
+		}
+		action := a.queue[0]
+		a.queue = a.queue[1:]
+		a.mu.Unlock()
+		action()
+	}
+}
@@ -0,0 +1,535 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var malTypeType = reflect.TypeOf((*MalType)(nil)).Elem()
+
+// TypeName returns the name of the type of a mal value used in error messages
+func TypeName(v MalType) string {
+	switch t := v.(type) {
+	case MalNumber:
+		return "number"
+	case MalString:
+		return "string"
+	case MalKeyword:
+		return "keyword"
+	case MalSymbol:
+		return "symbol"
+	case MalLiteral:
+		if t == MalNil {
+			return "nil"
+		}
+		return "boolean"
+	case MalList:
+		return "list"
+	case MalVector:
+		return "vector"
+	case MalHashmap:
+		return "hash-map"
+	case MalFunction, MalBuiltin, MalFunctionTCO:
+		return "function"
+	case *MalAtom:
+		return "atom"
+	case *MalRef:
+		return "ref"
+	case *MalAgent:
+		return "agent"
+	case MalGoValue:
+		return fmt.Sprintf("go value %T", t.Value)
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// isMalValue reports whether v is one of the mal types
+func isMalValue(v interface{}) bool {
+	switch v.(type) {
+	case MalNumber, MalString, MalKeyword, MalSymbol, MalLiteral, MalList, MalVector, MalHashmap,
+		MalFunction, MalBuiltin, MalFunctionTCO, *MalAtom, MalGoValue:
+		return true
+	default:
+		return false
+	}
+}
+
+// fieldName returns the name of a struct field in a hash-map following its json tag,
+// an empty name means the field is skipped
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" { // unexported
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, opts := tag, ""
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		name, opts = tag[:i], tag[i+1:]
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(opts, "omitempty")
+}
+
+// keyString returns the name of a string or keyword, a keyword stands for its name without ':'
+// wherever Go expects a string, as a hash-map key or as a value
+func keyString(k MalType) (string, bool) {
+	switch t := k.(type) {
+	case MalString:
+		return t.Value, true
+	case MalKeyword:
+		return t.Value, true
+	default:
+		return "", false
+	}
+}
+
+func typeError(v MalType, t reflect.Type) error {
+	return fmt.Errorf("expect %s but get %s", t, TypeName(v))
+}
+
+// toValue converts a mal value to a Go value of type t
+func toValue(v MalType, t reflect.Type) (reflect.Value, error) {
+	if t == malTypeType {
+		return reflect.ValueOf(&v).Elem(), nil
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		g, err := toGo(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if g == nil {
+			return reflect.Zero(t), nil
+		}
+		return reflect.ValueOf(g), nil
+	}
+	if g, ok := v.(MalGoValue); ok && g.Value != nil && reflect.TypeOf(g.Value).AssignableTo(t) {
+		return reflect.ValueOf(g.Value), nil
+	}
+	if v != nil && reflect.TypeOf(v).AssignableTo(t) && isMalValue(v) {
+		return reflect.ValueOf(v), nil
+	}
+	if v == MalNil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			return reflect.Zero(t), nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(MalNumber)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		rv := reflect.New(t).Elem()
+		if rv.OverflowInt(int64(n.Value)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n.Value, t)
+		}
+		rv.SetInt(int64(n.Value))
+		return rv, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := v.(MalNumber)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		rv := reflect.New(t).Elem()
+		if n.Value < 0 || rv.OverflowUint(uint64(n.Value)) {
+			return reflect.Value{}, fmt.Errorf("%d overflows %s", n.Value, t)
+		}
+		rv.SetUint(uint64(n.Value))
+		return rv, nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := v.(MalNumber)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		return reflect.ValueOf(float64(n.Value)).Convert(t), nil
+	case reflect.String:
+		s, ok := keyString(v)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		return reflect.ValueOf(s).Convert(t), nil
+	case reflect.Bool:
+		if v != MalTrue && v != MalFalse {
+			return reflect.Value{}, typeError(v, t)
+		}
+		return reflect.ValueOf(v == MalTrue).Convert(t), nil
+	case reflect.Slice:
+		var items []MalType
+		switch s := v.(type) {
+		case MalList:
+			items = s
+		case MalVector:
+			items = s
+		default:
+			return reflect.Value{}, typeError(v, t)
+		}
+		rv := reflect.MakeSlice(t, len(items), len(items))
+		for i, item := range items {
+			elem, err := toValue(item, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("element %d: %v", i, err)
+			}
+			rv.Index(i).Set(elem)
+		}
+		return rv, nil
+	case reflect.Map:
+		hm, ok := v.(MalHashmap)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		rv := reflect.MakeMapWithSize(t, len(hm))
+		for k, item := range hm {
+			key, err := toValue(k, t.Key())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %v: %v", k, err)
+			}
+			if rv.MapIndex(key).IsValid() {
+				return reflect.Value{}, fmt.Errorf("duplicate key %v", key)
+			}
+			elem, err := toValue(item, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %v", key, err)
+			}
+			rv.SetMapIndex(key, elem)
+		}
+		return rv, nil
+	case reflect.Struct:
+		hm, ok := v.(MalHashmap)
+		if !ok {
+			return reflect.Value{}, typeError(v, t)
+		}
+		rv := reflect.New(t).Elem()
+		for k, item := range hm {
+			key, ok := keyString(k)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("invalid key for %s: %s", t, TypeName(k))
+			}
+			i, ok := structField(t, key)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("no field %s in %s", key, t)
+			}
+			field, err := toValue(item, t.Field(i).Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("field %s: %v", key, err)
+			}
+			rv.Field(i).Set(field)
+		}
+		return rv, nil
+	case reflect.Func:
+		switch v.(type) {
+		case MalFunction, MalBuiltin, MalFunctionTCO:
+			return funcValue(v, t)
+		}
+		return reflect.Value{}, typeError(v, t)
+	case reflect.Ptr:
+		elem, err := toValue(v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		ptr := reflect.New(t.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+	}
+	return reflect.Value{}, typeError(v, t)
+}
+
+// structField finds the field of struct type t named key, by its exact name first
+// and then case-insensitively like encoding/json
+func structField(t reflect.Type, key string) (int, bool) {
+	fallback := -1
+	for i := 0; i < t.NumField(); i++ {
+		name, _ := fieldName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		if name == key {
+			return i, true
+		}
+		if fallback < 0 && strings.EqualFold(name, key) {
+			fallback = i
+		}
+	}
+	return fallback, fallback >= 0
+}
+
+// toGo converts a mal value to its natural Go representation
+func toGo(v MalType) (interface{}, error) {
+	switch t := v.(type) {
+	case MalNumber:
+		return t.Value, nil
+	case MalString:
+		return t.Value, nil
+	case MalKeyword:
+		return t.Value, nil
+	case MalLiteral:
+		switch t {
+		case MalTrue:
+			return true, nil
+		case MalFalse:
+			return false, nil
+		default:
+			return nil, nil
+		}
+	case MalList, MalVector:
+		var items []MalType
+		if l, ok := t.(MalList); ok {
+			items = l
+		} else {
+			items = t.(MalVector)
+		}
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			g, err := toGo(item)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+			result[i] = g
+		}
+		return result, nil
+	case MalHashmap:
+		result := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			key, ok := keyString(k)
+			if !ok {
+				return nil, fmt.Errorf("invalid key: %s", TypeName(k))
+			}
+			if _, ok := result[key]; ok {
+				return nil, fmt.Errorf("duplicate key %s", key)
+			}
+			g, err := toGo(item)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %v", key, err)
+			}
+			result[key] = g
+		}
+		return result, nil
+	case MalFunction, MalBuiltin, MalFunctionTCO:
+		return callback(v), nil
+	case MalGoValue:
+		return t.Value, nil
+	default:
+		return nil, fmt.Errorf("can't convert %s to a Go value", TypeName(v))
+	}
+}
+
+// callback wraps a mal function as a Go function converting its arguments and result
+func callback(f MalType) func(args ...interface{}) (interface{}, error) {
+	return func(args ...interface{}) (interface{}, error) {
+		malArgs := make(MalList, len(args))
+		for i, arg := range args {
+			v, err := FromGo(arg)
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: %v", i+1, err)
+			}
+			malArgs[i] = v
+		}
+		res, err := Call(f, malArgs...)
+		if err != nil {
+			return nil, err
+		}
+		return ToGo(res)
+	}
+}
+
+// callbackError is the panic raised by a wrapped mal function failing without an error result,
+// WrapFunc recovers it into an ordinary error
+type callbackError struct {
+	err error
+}
+
+// funcValue wraps a mal function as a Go function of type t
+// t may return a value and an error, errors panic if t can't return them
+func funcValue(f MalType, t reflect.Type) (reflect.Value, error) {
+	numOut := t.NumOut()
+	hasError := numOut > 0 && t.Out(numOut-1) == errorType
+	if numOut > 2 || (numOut == 2 && !hasError) {
+		return reflect.Value{}, fmt.Errorf("results of %s should be (value, error)", t)
+	}
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		out := make([]reflect.Value, numOut)
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		fail := func(err error) []reflect.Value {
+			if !hasError {
+				panic(callbackError{err})
+			}
+			out[numOut-1] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+		values := in
+		if t.IsVariadic() {
+			values = in[:len(in)-1]
+			for j, rest := 0, in[len(in)-1]; j < rest.Len(); j++ {
+				values = append(values, rest.Index(j))
+			}
+		}
+		args := make(MalList, len(values))
+		for i, value := range values {
+			v, err := fromValue(value)
+			if err != nil {
+				return fail(fmt.Errorf("argument %d: %v", i+1, err))
+			}
+			args[i] = v
+		}
+		res, err := Call(f, args...)
+		if err != nil {
+			return fail(err)
+		}
+		if numOut > 0 && !(numOut == 1 && hasError) {
+			v, err := toValue(res, t.Out(0))
+			if err != nil {
+				return fail(fmt.Errorf("result: %v", err))
+			}
+			out[0] = v
+		}
+		return out
+	}), nil
+}
+
+// ToGo converts a mal value to its natural Go representation: numbers to int, strings to string,
+// keywords to their name without ':', true and false to bool, nil to nil, lists and vectors to
+// []interface{}, hash-maps with string or keyword keys to map[string]interface{} and functions to
+// func(...interface{}) (interface{}, error)
+// keywords are converted the same way as keys and as values, so FromGo gives them back as strings,
+// and a hash-map with a keyword and a string of the same name as keys can't be converted
+func ToGo(v MalType) (interface{}, error) {
+	return toGo(v)
+}
+
+// hashable reports whether v can be a key of a hash-map, Go keys converted to collections can't
+func hashable(v MalType) bool {
+	switch v.(type) {
+	case MalList, MalVector, MalHashmap:
+		return false
+	default:
+		return true
+	}
+}
+
+// FromGo converts a Go value to a mal value: integers to numbers, strings to strings, bools to
+// true and false, nil to nil, slices and arrays to lists, maps to hash-maps, structs to hash-maps
+// keyed by keywords named after the json tags of their fields, functions to builtins and
+// anything else to MalGoValue
+func FromGo(v interface{}) (MalType, error) {
+	return fromValue(reflect.ValueOf(v))
+}
+
+// fromValue converts a Go value to a mal value
+func fromValue(rv reflect.Value) (MalType, error) {
+	return convertFrom(rv, false)
+}
+
+// convertFrom converts a Go value to a mal value, structs, pointers to them and maps or slices
+// with methods are kept as MalGoValue if opaque is true, so that their methods and fields are
+// still accessible
+func convertFrom(rv reflect.Value, opaque bool) (MalType, error) {
+	if !rv.IsValid() {
+		return MalNil, nil
+	}
+	if rv.CanInterface() && isMalValue(rv.Interface()) {
+		return rv.Interface(), nil
+	}
+	if opaque && rv.CanInterface() {
+		switch {
+		case rv.Kind() == reflect.Struct,
+			rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Struct,
+			(rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) && rv.Type().NumMethod() > 0:
+			return MalGoValue{Value: rv.Interface()}, nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		if int64(int(i)) != i {
+			return nil, fmt.Errorf("%d overflows a mal number", i)
+		}
+		return MalNumber{Value: int(i)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if n := int(u); n < 0 || uint64(n) != u {
+			return nil, fmt.Errorf("%d overflows a mal number", u)
+		}
+		return MalNumber{Value: int(u)}, nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != float64(int(f)) {
+			return nil, fmt.Errorf("can't represent %v as a mal number", f)
+		}
+		return MalNumber{Value: int(f)}, nil
+	case reflect.String:
+		return MalString{Value: rv.String()}, nil
+	case reflect.Bool:
+		return ToMalBool(rv.Bool()), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return MalList{}, nil
+		}
+		result := make(MalList, rv.Len())
+		for i := range result {
+			item, err := convertFrom(rv.Index(i), opaque)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %v", i, err)
+			}
+			result[i] = item
+		}
+		return result, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return MalNil, nil
+		}
+		result := make(MalHashmap, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			key, err := convertFrom(iter.Key(), opaque)
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %v", iter.Key(), err)
+			}
+			if !hashable(key) {
+				return nil, fmt.Errorf("key %v: a %s can't be a hash-map key", iter.Key(), TypeName(key))
+			}
+			item, err := convertFrom(iter.Value(), opaque)
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %v", iter.Key(), err)
+			}
+			result[key] = item
+		}
+		return result, nil
+	case reflect.Struct:
+		t := rv.Type()
+		result := make(MalHashmap)
+		for i := 0; i < t.NumField(); i++ {
+			name, omitEmpty := fieldName(t.Field(i))
+			if name == "" || (omitEmpty && rv.Field(i).IsZero()) {
+				continue
+			}
+			item, err := convertFrom(rv.Field(i), opaque)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", name, err)
+			}
+			result[MalKeyword{Value: name}] = item
+		}
+		return result, nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return MalNil, nil
+		}
+		return convertFrom(rv.Elem(), opaque)
+	case reflect.Func:
+		if rv.IsNil() {
+			return MalNil, nil
+		}
+		return wrapFunc(rv.Type().String(), rv.Interface(), opaque)
+	}
+	if !rv.CanInterface() {
+		return nil, fmt.Errorf("unsupported Go type %s", rv.Type())
+	}
+	return MalGoValue{Value: rv.Interface()}, nil
+}
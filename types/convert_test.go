@@ -0,0 +1,183 @@
+package types
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+type config struct {
+	Name    string   `json:"name"`
+	Port    int      `json:"port,omitempty"`
+	Tags    []string `json:"tags"`
+	Secret  string   `json:"-"`
+	private int
+}
+
+func TestToGo(t *testing.T) {
+	tests := []struct {
+		v    MalType
+		want interface{}
+	}{
+		{num(1), 1},
+		{str("a"), "a"},
+		{MalTrue, true},
+		{MalNil, nil},
+		{MalList{num(1), MalVector{str("a")}}, []interface{}{1, []interface{}{"a"}}},
+		{MalKeyword{Value: "a"}, "a"},
+		{MalHashmap{str("a"): num(1), MalKeyword{Value: "b"}: MalFalse}, map[string]interface{}{"a": 1, "b": false}},
+	}
+	for _, test := range tests {
+		got, err := ToGo(test.v)
+		if err != nil {
+			t.Errorf("ToGo(%v): %v", test.v, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ToGo(%v) = %#v, want %#v", test.v, got, test.want)
+		}
+	}
+	for _, v := range []MalType{
+		MalSymbol{Value: "x"},
+		MalHashmap{num(1): num(2)},
+		MalHashmap{str("a"): num(1), MalKeyword{Value: "a"}: num(2)},
+	} {
+		if got, err := ToGo(v); err == nil {
+			t.Errorf("ToGo(%v) = %v, want an error", v, got)
+		}
+	}
+}
+
+func TestFromGo(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want MalType
+	}{
+		{int64(-5), num(-5)},
+		{uint64(math.MaxInt64), num(math.MaxInt64)},
+		{uint8(7), num(7)},
+		{2.0, num(2)},
+		{"a", str("a")},
+		{false, MalFalse},
+		{nil, MalNil},
+		{[]int{1, 2}, MalList{num(1), num(2)}},
+		{[2]string{"a", "b"}, MalList{str("a"), str("b")}},
+		{map[string]int{"a": 1}, MalHashmap{str("a"): num(1)}},
+		{map[interface{}]int{"a": 1}, MalHashmap{str("a"): num(1)}},
+		{&config{Name: "web", Tags: []string{"x"}, Secret: "s", private: 1},
+			MalHashmap{MalKeyword{Value: "name"}: str("web"), MalKeyword{Value: "tags"}: MalList{str("x")}}},
+	}
+	for _, test := range tests {
+		got, err := FromGo(test.v)
+		if err != nil {
+			t.Errorf("FromGo(%v): %v", test.v, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FromGo(%v) = %#v, want %#v", test.v, got, test.want)
+		}
+	}
+}
+
+// Go values which have no mal representation are reported rather than panicking or wrapping
+func TestFromGoErrors(t *testing.T) {
+	tests := map[string]interface{}{
+		"fraction":          2.5,
+		"array key":         map[[2]int]string{{1, 2}: "a"},
+		"struct key":        map[struct{ X, Y int }]int{{1, 2}: 3},
+		"pointer key":       map[*struct{ X int }]int{{1}: 2},
+		"interface key":     map[interface{}]int{[1]int{1}: 1},
+		"uint64 overflow":   uint64(1<<63 + 5),
+		"max uint64":        uint64(math.MaxUint64),
+		"overflow in slice": []uint64{1, math.MaxUint64},
+	}
+	for name, v := range tests {
+		if got, err := FromGo(v); err == nil {
+			t.Errorf("%s: FromGo(%v) = %v, want an error", name, v, got)
+		}
+	}
+}
+
+// structs go through hash-maps keyed by their json names and come back unchanged
+func TestStructRoundTrip(t *testing.T) {
+	want := config{Name: "web", Port: 8080, Tags: []string{"a", "b"}}
+	v, err := FromGo(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got config
+	f := mustWrap(t, "set", func(c config) { got = c })
+	if _, err := f(v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip of %+v gives %+v", want, got)
+	}
+}
+
+func TestMalFunctionsAsGoFunctions(t *testing.T) {
+	inc := MalBuiltin{Name: "inc", Fn: func(args ...MalType) (MalType, error) {
+		n, ok := args[0].(MalNumber)
+		if !ok {
+			return nil, typeError(args[0], reflect.TypeOf(0))
+		}
+		return num(n.Value + 1), nil
+	}}
+	g, err := ToGo(inc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := g.(func(...interface{}) (interface{}, error))(41)
+	if err != nil || res != 42 {
+		t.Errorf("callback(41) = %v, %v, want 42", res, err)
+	}
+	apply := mustWrap(t, "apply", func(f func(int) int, x int) int { return f(x) })
+	if got, err := apply(inc, num(1)); err != nil || got != num(2) {
+		t.Errorf("(apply inc 1) = %v, %v, want 2", got, err)
+	}
+	try := mustWrap(t, "try", func(f func(string) (int, error), s string) (int, error) { return f(s) })
+	if _, err := try(inc, str("a")); err == nil {
+		t.Error("(try inc \"a\") succeeds, want the error of inc")
+	}
+	// a function without an error result reports the failure of its mal function through WrapFunc
+	strict := mustWrap(t, "strict", func(f func(string) int) int { return f("a") })
+	if _, err := strict(inc); err == nil {
+		t.Error("(strict inc) succeeds, want the error of inc")
+	}
+}
+
+// keywords are their name without ':' as keys and as values, both ways
+func TestKeywordRoundTrip(t *testing.T) {
+	kw := func(s string) MalKeyword {
+		return MalKeyword{Value: s}
+	}
+	v := MalHashmap{kw("mode"): kw("fast"), str("tags"): MalVector{kw("a"), str("b")}}
+	g, err := ToGo(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"mode": "fast", "tags": []interface{}{"a", "b"}}
+	if !reflect.DeepEqual(g, want) {
+		t.Fatalf("ToGo(%v) = %#v, want %#v", v, g, want)
+	}
+	back, err := FromGo(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ToGo(back); err != nil || !reflect.DeepEqual(again, g) {
+		t.Fatalf("ToGo(FromGo(%#v)) = %#v, %v", g, again, err)
+	}
+	rv, err := toValue(v, reflect.TypeOf(map[string]interface{}{}))
+	if err != nil || !reflect.DeepEqual(rv.Interface(), want) {
+		t.Fatalf("toValue(%v) = %v, %v, want %#v", v, rv, err, want)
+	}
+	var typed map[string]string
+	rv, err = toValue(MalHashmap{kw("mode"): kw("fast")}, reflect.TypeOf(typed))
+	if err != nil || !reflect.DeepEqual(rv.Interface(), map[string]string{"mode": "fast"}) {
+		t.Fatalf("toValue to %T = %v, %v", typed, rv, err)
+	}
+	if _, err := toValue(MalHashmap{kw("a"): num(1), str("a"): num(2)}, reflect.TypeOf(map[string]int{})); err == nil ||
+		err.Error() != "duplicate key a" {
+		t.Fatalf("toValue of a keyword and a string key of the same name fails with %v, want duplicate key a", err)
+	}
+}
@@ -0,0 +1,54 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// CallMethod calls the exported method `name` of a wrapped Go value with args, results which
+// are structs or pointers to them are wrapped again so that calls can be chained
+// methods with pointer receivers can only be called on wrapped pointers, calling them on a
+// copy would lose what they change
+func CallMethod(obj MalType, name string, args ...MalType) (MalType, error) {
+	g, ok := obj.(MalGoValue)
+	if !ok || g.Value == nil {
+		return nil, fmt.Errorf("can't call method %s on %s", name, TypeName(obj))
+	}
+	rv := reflect.ValueOf(g.Value)
+	method := rv.MethodByName(name)
+	if _, ok := reflect.PtrTo(rv.Type()).MethodByName(name); !method.IsValid() && ok {
+		return nil, fmt.Errorf("method %s of %s has a pointer receiver, can't call it on a %s value",
+			name, reflect.PtrTo(rv.Type()), rv.Type())
+	}
+	if !method.IsValid() {
+		return nil, fmt.Errorf("no method %s in %s", name, rv.Type())
+	}
+	f, err := wrapFunc(name, method.Interface(), true)
+	if err != nil {
+		return nil, err
+	}
+	return f(args...)
+}
+
+// GetField returns the exported field `name` of a wrapped Go struct or pointer to struct
+func GetField(obj MalType, name string) (MalType, error) {
+	g, ok := obj.(MalGoValue)
+	if !ok || g.Value == nil {
+		return nil, fmt.Errorf("can't read field %s of %s", name, TypeName(obj))
+	}
+	rv := reflect.ValueOf(g.Value)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("can't read field %s of a nil %s", name, rv.Type())
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("can't read field %s of %s", name, rv.Type())
+	}
+	f, ok := rv.Type().FieldByName(name)
+	if !ok || f.PkgPath != "" {
+		return nil, fmt.Errorf("no exported field %s in %s", name, rv.Type())
+	}
+	return convertFrom(rv.FieldByIndex(f.Index), true)
+}
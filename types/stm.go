@@ -0,0 +1,283 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// maxHistory is the number of committed values kept by a ref for older transactions to read
+const maxHistory = 10
+
+// maxRetries is the number of times a transaction is retried before giving up
+const maxRetries = 10000
+
+var (
+	// ErrRetry aborts the running transaction so that it's retried
+	ErrRetry = errors.New("transaction conflict")
+	// ErrNoTxn is returned when a ref is changed outside of a transaction
+	ErrNoTxn = errors.New("no transaction running")
+	// ErrCommitting is returned when a function of commute uses refs while it's applied on commit
+	ErrCommitting = errors.New("refs can't be used by the function of commute while it's committed")
+)
+
+var (
+	// stmClock is the commit point of the latest transaction
+	stmClock uint64
+	refIDs   uint64
+)
+
+type refVersion struct {
+	value MalType
+	point uint64
+}
+
+// NewRef creates a ref holding v
+func NewRef(v MalType) *MalRef {
+	return &MalRef{
+		id:      atomic.AddUint64(&refIDs, 1),
+		history: []refVersion{{value: v, point: atomic.LoadUint64(&stmClock)}},
+	}
+}
+
+// Deref returns the latest committed value
+func (r *MalRef) Deref() MalType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.history[len(r.history)-1].value
+}
+
+// at returns the value committed at or before point
+func (r *MalRef) at(point uint64) (MalType, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if r.history[i].point <= point {
+			return r.history[i].value, true
+		}
+	}
+	return nil, false
+}
+
+// latestPoint returns the commit point of the latest value, the caller must hold r.mu
+func (r *MalRef) latestPoint() uint64 {
+	return r.history[len(r.history)-1].point
+}
+
+// Txn is a transaction over refs
+type Txn struct {
+	mu        sync.Mutex
+	readPoint uint64
+	values    map[*MalRef]MalType
+	sets      map[*MalRef]bool
+	ensures   map[*MalRef]bool
+	commutes  map[*MalRef][]func(MalType) (MalType, error)
+	// committing is set once the body is done, commit applies the functions of commute again
+	committing bool
+	// sends are dispatched to agents once the transaction commits
+	sends []func()
+}
+
+type txnKey struct{}
+
+// WithTxn returns a context carrying txn, which is nil outside of transactions
+func WithTxn(ctx context.Context, txn *Txn) context.Context {
+	if ctx.Value(txnKey{}) == nil && txn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, txnKey{}, txn)
+}
+
+// TxnFrom returns the transaction carried by ctx, or nil
+func TxnFrom(ctx context.Context) *Txn {
+	txn, _ := ctx.Value(txnKey{}).(*Txn)
+	return txn
+}
+
+// RunTxn runs f in a transaction, retrying it on conflicts, and commits its changes
+func RunTxn(f func(txn *Txn) (MalType, error)) (MalType, error) {
+	for i := 0; i < maxRetries; i++ {
+		txn := &Txn{
+			readPoint: atomic.LoadUint64(&stmClock),
+			values:    make(map[*MalRef]MalType),
+			sets:      make(map[*MalRef]bool),
+			ensures:   make(map[*MalRef]bool),
+			commutes:  make(map[*MalRef][]func(MalType) (MalType, error)),
+		}
+		v, err := f(txn)
+		if err == nil {
+			err = txn.commit()
+		}
+		if errors.Is(err, ErrRetry) {
+			continue
+		}
+		return v, err
+	}
+	return nil, errors.New("transaction failed after too many retries")
+}
+
+// checkCommitting fails once commit applies the functions of commute, it must come before
+// anything locks a ref, which commit holds locked meanwhile
+func (t *Txn) checkCommitting() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.committing {
+		return ErrCommitting
+	}
+	return nil
+}
+
+// Read returns the value of r in the transaction
+func (t *Txn) Read(r *MalRef) (MalType, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.committing {
+		return nil, ErrCommitting
+	}
+	return t.read(r)
+}
+
+func (t *Txn) read(r *MalRef) (MalType, error) {
+	if v, ok := t.values[r]; ok {
+		return v, nil
+	}
+	v, ok := r.at(t.readPoint)
+	if !ok { // the snapshot is no longer in the history
+		return nil, ErrRetry
+	}
+	return v, nil
+}
+
+// changedSince reports whether r was committed after the transaction started
+func (t *Txn) changedSince(r *MalRef) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latestPoint() > t.readPoint
+}
+
+// Alter sets r to f(value of r in the transaction)
+// f runs without t locked, it may read and change refs in the transaction as well
+func (t *Txn) Alter(r *MalRef, f func(MalType) (MalType, error)) (MalType, error) {
+	if err := t.checkCommitting(); err != nil {
+		return nil, err
+	}
+	if t.changedSince(r) {
+		return nil, ErrRetry
+	}
+	old, err := t.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	v, err := f(old)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.values[r] = v
+	t.sets[r] = true
+	return v, nil
+}
+
+// Commute sets r to f(value of r in the transaction), f is applied again to the latest value
+// when committing, so commutes never conflict
+func (t *Txn) Commute(r *MalRef, f func(MalType) (MalType, error)) (MalType, error) {
+	if err := t.checkCommitting(); err != nil {
+		return nil, err
+	}
+	old, err := t.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	v, err := f(old)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.values[r] = v
+	t.commutes[r] = append(t.commutes[r], f)
+	return v, nil
+}
+
+// Ensure protects r from being changed by other transactions until this one commits
+func (t *Txn) Ensure(r *MalRef) (MalType, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.committing {
+		return nil, ErrCommitting
+	}
+	t.ensures[r] = true
+	return t.read(r)
+}
+
+// Send queues an agent action until the transaction commits
+func (t *Txn) Send(send func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sends = append(t.sends, send)
+}
+
+// t isn't kept locked, the functions of commute it applies may call it and must fail rather than
+// wait for it
+func (t *Txn) commit() error {
+	t.mu.Lock()
+	t.committing = true
+	t.mu.Unlock()
+	touched := make(map[*MalRef]bool)
+	for _, set := range []map[*MalRef]bool{t.sets, t.ensures} {
+		for r := range set {
+			touched[r] = true
+		}
+	}
+	for r := range t.commutes {
+		touched[r] = true
+	}
+	refs := make([]*MalRef, 0, len(touched))
+	for r := range touched {
+		refs = append(refs, r)
+	}
+	// lock in a global order to avoid deadlocks between committing transactions
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].id < refs[j].id
+	})
+	for _, r := range refs {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	}
+	for _, r := range refs {
+		if (t.sets[r] || t.ensures[r]) && r.latestPoint() > t.readPoint {
+			return ErrRetry
+		}
+	}
+	values := make(map[*MalRef]MalType)
+	for r, fs := range t.commutes {
+		if t.sets[r] {
+			continue
+		}
+		v := r.history[len(r.history)-1].value
+		for _, f := range fs {
+			var err error
+			if v, err = f(v); err != nil {
+				return err
+			}
+		}
+		values[r] = v
+	}
+	for r := range t.sets {
+		values[r] = t.values[r]
+	}
+	point := atomic.AddUint64(&stmClock, 1)
+	for r, v := range values {
+		r.history = append(r.history, refVersion{value: v, point: point})
+		if len(r.history) > maxHistory {
+			r.history = r.history[len(r.history)-maxHistory:]
+		}
+	}
+	for _, send := range t.sends {
+		send()
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package types
+
+import "sync"
+
+// symbols interns the names of symbols to small integer ids
+var symbols = struct {
+	sync.RWMutex
+	ids   map[string]int
+	names []string
+}{ids: make(map[string]int)}
+
+// Intern returns the id of the symbol name, ids are allocated on first use
+func Intern(name string) int {
+	symbols.RLock()
+	id, ok := symbols.ids[name]
+	symbols.RUnlock()
+	if ok {
+		return id
+	}
+	symbols.Lock()
+	defer symbols.Unlock()
+	if id, ok := symbols.ids[name]; ok {
+		return id
+	}
+	id = len(symbols.names)
+	symbols.ids[name] = id
+	symbols.names = append(symbols.names, name)
+	return id
+}
+
+// SymbolName returns the name of an interned symbol
+func SymbolName(id int) string {
+	symbols.RLock()
+	defer symbols.RUnlock()
+	return symbols.names[id]
+}
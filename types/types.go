@@ -1,5 +1,10 @@
 package types
 
+import (
+	"context"
+	"sync"
+)
+
 type MalType interface {
 }
 
@@ -33,11 +38,76 @@ type MalSymbol struct {
 
 type MalFunction func(args ...MalType) (MalType, error)
 
+// MalContextFunction is a native function which may block, it returns early when ctx is done
+type MalContextFunction func(ctx context.Context, args ...MalType) (MalType, error)
+
+// MalBuiltin is a native function along with the name it's bound to
+// blocking builtins set CtxFn instead of Fn, so that they can be canceled with the evaluation
+type MalBuiltin struct {
+	Name  string
+	Fn    MalFunction
+	CtxFn MalContextFunction
+}
+
+// MalFunctionTCO is a user defined function, Name is set when it's bound by `def!`
+// Compiled caches the body as compiled by the evaluator, so that calls skip analyzing AST
+// functions of several arities have the parameters of each in Arities, and their clauses in AST
+// functions created by the evaluator set CtxFn instead of Function, so that a call made by a builtin
+// continues the evaluation calling the builtin, with its transaction and limits
 type MalFunctionTCO struct {
+	Name     string
 	AST      MalType
 	Params   MalList
+	Arities  []MalVector
 	Env      MalEnv
 	Function MalFunction
+	CtxFn    MalContextFunction
+	Compiled interface{}
+}
+
+// MalAtom is a mutable reference to a mal value, it's safe for concurrent use
+type MalAtom struct {
+	mu      sync.Mutex
+	Value   MalType
+	version uint64
+}
+
+// MalChannel passes mal values between goroutines
+type MalChannel struct {
+	Ch     chan MalType
+	closed int32
+}
+
+// MalFuture is the result of a computation running on another goroutine
+type MalFuture struct {
+	pending
+}
+
+// MalPromise is a value delivered once by another goroutine
+type MalPromise struct {
+	pending
+}
+
+// MalRef is a reference changed only in transactions, it keeps some committed versions
+// so that transactions read a consistent snapshot (MVCC)
+type MalRef struct {
+	id      uint64
+	mu      sync.Mutex
+	history []refVersion // the oldest first
+}
+
+// MalAgent holds a value changed asynchronously by the actions sent to it, one at a time
+type MalAgent struct {
+	mu      sync.Mutex
+	state   MalType
+	err     error
+	queue   []func()
+	running bool
+}
+
+// MalGoValue wraps an arbitrary Go value so that mal code can call its methods and read its fields
+type MalGoValue struct {
+	Value interface{}
 }
 
 type MalEnv interface {
@@ -1,5 +1,10 @@
 package types
 
+import (
+	"context"
+	"fmt"
+)
+
 func ToMalBool(b bool) MalLiteral {
 	if b {
 		return MalTrue
@@ -18,3 +23,28 @@ func NotMalBool(mb MalLiteral) MalLiteral {
 		return mb
 	}
 }
+
+// Call invokes a mal function with args
+func Call(f MalType, args ...MalType) (MalType, error) {
+	return CallContext(context.Background(), f, args...)
+}
+
+// CallContext invokes a mal function with args, blocking builtins return early when ctx is done
+func CallContext(ctx context.Context, f MalType, args ...MalType) (MalType, error) {
+	switch fn := f.(type) {
+	case MalFunction:
+		return fn(args...)
+	case MalBuiltin:
+		if fn.CtxFn != nil {
+			return fn.CtxFn(ctx, args...)
+		}
+		return fn.Fn(args...)
+	case MalFunctionTCO:
+		if fn.CtxFn != nil {
+			return fn.CtxFn(ctx, args...)
+		}
+		return fn.Function(args...)
+	default:
+		return nil, fmt.Errorf("invalid function calling")
+	}
+}
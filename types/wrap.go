@@ -0,0 +1,80 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// WrapFunc turns a Go function into a mal function named `name`, converting the arguments
+// from mal values and the result back to a mal value
+// fn may return nothing, a value, an error or a value and an error, a panic of fn is an error too
+func WrapFunc(name string, fn interface{}) (MalFunction, error) {
+	return wrapFunc(name, fn, false)
+}
+
+// wrapFunc is WrapFunc keeping structs in the result as MalGoValue if opaque is true
+func wrapFunc(name string, fn interface{}, opaque bool) (MalFunction, error) {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%s: %T is not a function", name, fn)
+	}
+	ft := fv.Type()
+	switch {
+	case ft.NumOut() > 2,
+		ft.NumOut() == 2 && ft.Out(1) != errorType:
+		return nil, fmt.Errorf("%s: results of %s should be (value, error)", name, ft)
+	}
+	numIn := ft.NumIn()
+	return func(args ...MalType) (result MalType, err error) {
+		// a panic of fn, or of a mal function failing in it, fails the call
+		defer func() {
+			if r := recover(); r != nil {
+				if cbErr, ok := r.(callbackError); ok {
+					result, err = nil, fmt.Errorf("%s: %v", name, cbErr.err)
+				} else {
+					result, err = nil, fmt.Errorf("%s: panic: %v", name, r)
+				}
+			}
+		}()
+		if ft.IsVariadic() {
+			if len(args) < numIn-1 {
+				return nil, fmt.Errorf("%s: incorrect number of arguments: expect at least %d but get %d",
+					name, numIn-1, len(args))
+			}
+		} else if len(args) != numIn {
+			return nil, fmt.Errorf("%s: incorrect number of arguments: expect %d but get %d",
+				name, numIn, len(args))
+		}
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var t reflect.Type
+			if ft.IsVariadic() && i >= numIn-1 {
+				t = ft.In(numIn - 1).Elem()
+			} else {
+				t = ft.In(i)
+			}
+			v, err := toValue(arg, t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: argument %d: %v", name, i+1, err)
+			}
+			in[i] = v
+		}
+		out := fv.Call(in)
+		if len(out) > 0 && out[len(out)-1].Type() == errorType {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return nil, err
+			}
+			out = out[:len(out)-1]
+		}
+		if len(out) == 0 {
+			return MalNil, nil
+		}
+		res, err := convertFrom(out[0], opaque)
+		if err != nil {
+			return nil, fmt.Errorf("%s: result: %v", name, err)
+		}
+		return res, nil
+	}, nil
+}
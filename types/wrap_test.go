@@ -0,0 +1,115 @@
+package types
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X int `json:"x"`
+	Y int `json:"y,omitempty"`
+}
+
+func mustWrap(t *testing.T, name string, fn interface{}) MalFunction {
+	t.Helper()
+	f, err := WrapFunc(name, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func num(n int) MalNumber {
+	return MalNumber{Value: n}
+}
+
+func str(s string) MalString {
+	return MalString{Value: s}
+}
+
+func TestWrapFuncConvertsArguments(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{}
+		args []MalType
+		want MalType
+	}{
+		{"repeat", strings.Repeat, []MalType{str("ab"), num(3)}, str("ababab")},
+		{"sum", func(xs []int) int {
+			s := 0
+			for _, x := range xs {
+				s += x
+			}
+			return s
+		}, []MalType{MalVector{num(1), num(2), num(3)}}, num(6)},
+		{"len", func(m map[string]int) int { return len(m) },
+			[]MalType{MalHashmap{MalKeyword{Value: "a"}: num(1), str("b"): num(2)}}, num(2)},
+		{"norm", func(p point) int { return p.X*p.X + p.Y*p.Y },
+			[]MalType{MalHashmap{MalKeyword{Value: "x"}: num(3), MalKeyword{Value: "y"}: num(4)}}, num(25)},
+		{"scale", func(p *point, k int) point { return point{p.X * k, p.Y * k} },
+			[]MalType{MalHashmap{MalKeyword{Value: "x"}: num(1)}, num(2)}, MalHashmap{MalKeyword{Value: "x"}: num(2)}},
+		{"join", func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+			[]MalType{str("-"), str("a"), str("b")}, str("a-b")},
+		{"not", func(b bool) bool { return !b }, []MalType{MalFalse}, MalTrue},
+		{"nothing", func() {}, nil, MalNil},
+		{"id", func(v MalType) MalType { return v }, []MalType{MalList{num(1)}}, MalList{num(1)}},
+		{"chan", func() chan int { return nil }, nil, MalGoValue{Value: (chan int)(nil)}},
+	}
+	for _, test := range tests {
+		got, err := mustWrap(t, test.name, test.fn)(test.args...)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s returns %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWrapFuncErrors(t *testing.T) {
+	failing := errors.New("failing")
+	tests := []struct {
+		name string
+		fn   interface{}
+		args []MalType
+		want string
+	}{
+		{"repeat", strings.Repeat, []MalType{str("a")},
+			"repeat: incorrect number of arguments: expect 2 but get 1"},
+		{"join", func(sep string, parts ...string) string { return sep }, nil,
+			"join: incorrect number of arguments: expect at least 1 but get 0"},
+		{"repeat", strings.Repeat, []MalType{num(1), num(2)},
+			"repeat: argument 1: expect string but get number"},
+		{"sum", func(xs []int) int { return 0 }, []MalType{MalList{num(1), str("x")}},
+			"sum: argument 1: element 1: expect int but get string"},
+		{"byte", func(b uint8) uint8 { return b }, []MalType{num(256)},
+			"byte: argument 1: 256 overflows uint8"},
+		{"norm", func(p point) int { return 0 }, []MalType{MalHashmap{MalKeyword{Value: "z"}: num(1)}},
+			"norm: argument 1: no field z in types.point"},
+		{"fail", func() (int, error) { return 0, failing }, nil, "failing"},
+		{"crash", func() int { panic("crash") }, nil, "crash: panic: crash"},
+		{"index", func(xs []int) int { return xs[1] }, []MalType{MalVector{num(1)}},
+			"index: panic: runtime error: index out of range [1] with length 1"},
+	}
+	for _, test := range tests {
+		_, err := mustWrap(t, test.name, test.fn)(test.args...)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s fails with %v, want %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestWrapFuncRejectsSignatures(t *testing.T) {
+	for _, fn := range []interface{}{
+		42,
+		func() (int, int) { return 0, 0 },
+		func() (int, error, error) { return 0, nil, nil },
+	} {
+		if _, err := WrapFunc("f", fn); err == nil {
+			t.Errorf("WrapFunc(%T) succeeds, want an error", fn)
+		}
+	}
+}